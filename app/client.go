@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type ClientFlag uint32
+
+const (
+	ClientMaster  ClientFlag = 1 << iota // the link a replica receives the replication stream on
+	ClientReplica                        // a replica connected to us
+	ClientPubSub                         // subscribed to at least one channel
+	ClientBlocked                        // waiting inside a blocking command
+	ClientCloseAfterReply
+	ClientTracking            // CLIENT TRACKING is on
+	ClientTrackingBcast       // tracking by prefix instead of by the keys read
+	ClientTrackingOptIn       // only keys read right after CLIENT CACHING yes
+	ClientTrackingOptOut      // every key except after CLIENT CACHING no
+	ClientTrackingNoLoop      // no invalidations for keys the client changed itself
+	ClientTrackingCaching     // CLIENT CACHING was called for the next command
+	ClientTrackingBrokenRedir // the redirect target went away
+	ClientReplyOff            // CLIENT REPLY OFF
+	ClientReplySkipNext       // CLIENT REPLY SKIP was just called
+	ClientReplySkip           // the reply to the current command is dropped
+	ClientNoEvict             // excluded from client eviction
+	ClientNoTouch             // reads don't update the access time of keys
+)
+
+type Client struct {
+	Conn          net.Conn
+	ID            int64
+	Name          string
+	Addr          string
+	LAddr         string
+	Created       time.Time
+	Proto         int  // 2 or 3, negotiated with HELLO
+	Authenticated bool // only checked when requirepass is set
+	User          string
+	LibName       string
+	LibVer        string
+	DB            int
+	flags         ClientFlag
+	fd            int
+
+	channels         map[string]bool // pub/sub subscriptions
+	trackingRedirect int64           // client the invalidations go to, 0 for ourselves
+	trackingPrefixes []string        // BCAST prefixes, an empty one matches every key
+	replAckOffset    int             // last offset a replica confirmed with REPLCONF ACK
+
+	// only touched by the goroutine running the client's commands: dirty
+	// counts the keys it changed, propagate replaces the command sent to the
+	// replicas when the handler sets it
+	dirty     int
+	propagate []string
+
+	lastInteraction time.Time
+	lastCmd         string
+	argvLen         int // bytes in the arguments of the command being run
+	queryBuf        int // bytes read but not decoded yet
+	queryBufCap     int
+
+	protocol *ProtocolHandler
+	config   *Config
+	reader   *RESPReader
+
+	// replies are queued in out and written to the socket by writeLoop, so a
+	// slow reader never blocks whoever produced the reply, propagateWrite
+	// included. inFlight is what writeLoop took and is still writing.
+	out            bytes.Buffer
+	inFlight       int
+	outCond        *sync.Cond
+	outDone        chan struct{}
+	closing        bool      // writeLoop drains what is left and stops
+	softLimitSince time.Time // when the soft output limit was first exceeded
+
+	// guards the output queue and every field above that other connections
+	// read through CLIENT LIST, replicas are also written to by propagateWrite
+	mu sync.Mutex
+}
+
+// drainTimeout is how long a closing client gets to read its last replies
+const drainTimeout = 5 * time.Second
+
+func (s *RedisServer) newClient(conn net.Conn) *Client {
+	reader := s.protocol.NewReader(conn)
+	reader.limits = s.config.readLimits()
+
+	now := time.Now()
+	c := &Client{
+		Conn:            conn,
+		ID:              s.nextClientID.Add(1),
+		Addr:            conn.RemoteAddr().String(),
+		LAddr:           conn.LocalAddr().String(),
+		Created:         now,
+		lastInteraction: now,
+		Proto:           2,
+		User:            "default",
+		fd:              connFD(conn),
+		channels:        make(map[string]bool),
+		protocol:        s.protocol,
+		config:          s.config,
+		reader:          reader,
+		outDone:         make(chan struct{}),
+	}
+	c.outCond = sync.NewCond(&c.mu)
+	go c.writeLoop()
+	return c
+}
+
+// connFD digs the file descriptor out for CLIENT LIST, -1 when there is none
+func connFD(conn net.Conn) int {
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	fd := -1
+	raw.Control(func(f uintptr) { fd = int(f) })
+	return fd
+}
+
+// applyKeepAlive sets tcp-keepalive on TCP connections, TLS ones included
+func (s *RedisServer) applyKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAliveConfig(s.config.keepAliveConfig())
+	}
+}
+
+// timeoutExempt is true for the clients Redis never closes for being idle:
+// replication links, subscribers waiting for messages and blocked clients
+func (c *Client) timeoutExempt() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags&(ClientMaster|ClientReplica|ClientPubSub|ClientBlocked) != 0
+}
+
+// clientsCron closes normal clients that have been idle for longer than
+// the timeout setting
+func (s *RedisServer) clientsCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.config.mu.RLock()
+		timeout := time.Duration(s.config.Timeout) * time.Second
+		s.config.mu.RUnlock()
+
+		if timeout == 0 {
+			continue
+		}
+
+		for _, c := range s.Clients() {
+			if c.timeoutExempt() {
+				continue
+			}
+			if c.Idle() > timeout {
+				log.Printf("Closing idle client %d (%s)", c.ID, c.Addr)
+				c.Conn.Close()
+			}
+		}
+	}
+}
+
+func (s *RedisServer) registerClient(c *Client) {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	s.clients[c.ID] = c
+}
+
+func (s *RedisServer) unregisterClient(c *Client) {
+	s.clientsMu.Lock()
+	delete(s.clients, c.ID)
+	s.clientsMu.Unlock()
+
+	s.unsubscribeAll(c, false)
+	s.disableTracking(c)
+
+	if c.hasFlag(ClientReplica) {
+		s.RemoveReplica(c.Addr)
+	}
+}
+
+func (s *RedisServer) lookupClient(id int64) *Client {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+	return s.clients[id]
+}
+
+// Clients returns a snapshot of every connected client ordered by ID
+func (s *RedisServer) Clients() []*Client {
+	s.clientsMu.RLock()
+	defer s.clientsMu.RUnlock()
+
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+func (c *Client) hasFlag(flag ClientFlag) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags&flag != 0
+}
+
+func (c *Client) setFlag(flag ClientFlag, on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if on {
+		c.flags |= flag
+	} else {
+		c.flags &^= flag
+	}
+}
+
+// beginCommand records what CLIENT LIST shows as cmd, idle and argv-mem
+func (c *Client) beginCommand(name string, args []string) {
+	argvLen := len(name)
+	for _, arg := range args {
+		argvLen += len(arg)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastCmd = name
+	c.lastInteraction = time.Now()
+	c.argvLen = argvLen
+}
+
+func (c *Client) endCommand() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.argvLen = 0
+}
+
+// Idle is how long since the client last sent anything, partial commands count
+func (c *Client) Idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idleLocked(time.Now())
+}
+
+func (c *Client) idleLocked(now time.Time) time.Duration {
+	last := c.lastInteraction
+	if read := c.reader.lastRead.Load(); read > last.UnixNano() {
+		last = time.Unix(0, read)
+	}
+	return now.Sub(last)
+}
+
+func (c *Client) setQueryBuf(used int, capacity int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queryBuf = used
+	c.queryBufCap = capacity
+}
+
+// Type is the class CLIENT LIST TYPE and CLIENT KILL TYPE filter on
+func (c *Client) Type() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.typeLocked()
+}
+
+func (c *Client) typeLocked() string {
+	switch {
+	case c.flags&ClientMaster != 0:
+		return "master"
+	case c.flags&ClientReplica != 0:
+		return "replica"
+	case c.flags&ClientPubSub != 0:
+		return "pubsub"
+	}
+	return "normal"
+}
+
+func (c *Client) flagString() string {
+	var b strings.Builder
+	if c.flags&ClientReplica != 0 {
+		b.WriteByte('S')
+	}
+	if c.flags&ClientMaster != 0 {
+		b.WriteByte('M')
+	}
+	if c.flags&ClientPubSub != 0 {
+		b.WriteByte('P')
+	}
+	if c.flags&ClientBlocked != 0 {
+		b.WriteByte('b')
+	}
+	if c.flags&ClientCloseAfterReply != 0 {
+		b.WriteByte('c')
+	}
+	if c.flags&ClientTracking != 0 {
+		b.WriteByte('t')
+	}
+	if c.flags&ClientTrackingBrokenRedir != 0 {
+		b.WriteByte('R')
+	}
+	if c.flags&ClientTrackingBcast != 0 {
+		b.WriteByte('B')
+	}
+	if c.flags&ClientNoEvict != 0 {
+		b.WriteByte('e')
+	}
+	if c.flags&ClientNoTouch != 0 {
+		b.WriteByte('T')
+	}
+	if b.Len() == 0 {
+		b.WriteByte('N')
+	}
+	return b.String()
+}
+
+// Info is the line CLIENT LIST and CLIENT INFO print for this client
+func (c *Client) Info() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.infoLocked()
+}
+
+func (c *Client) infoLocked() string {
+	now := time.Now()
+	cmd := c.lastCmd
+	if cmd == "" {
+		cmd = "NULL"
+	}
+	redir := int64(-1)
+	if c.flags&ClientTracking != 0 {
+		redir = c.trackingRedirect
+	}
+	obl := c.out.Len() + c.inFlight
+	omem := c.out.Cap() + c.inFlight
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=%d name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=0 ssub=0 multi=-1 watch=0 qbuf=%d qbuf-free=%d argv-mem=%d multi-mem=0 rbs=%d rbp=%d obl=%d oll=0 omem=%d tot-mem=%d events=r cmd=%s user=%s redir=%d resp=%d lib-name=%s lib-ver=%s",
+		c.ID, c.Addr, c.LAddr, c.fd, c.Name,
+		int64(now.Sub(c.Created).Seconds()), int64(c.idleLocked(now).Seconds()),
+		c.flagString(), c.DB, len(c.channels),
+		c.queryBuf, c.queryBufCap-c.queryBuf, c.argvLen, c.queryBufCap, c.queryBuf,
+		obl, omem, c.queryBufCap+omem+c.argvLen,
+		cmd, c.User, redir, c.Proto, c.LibName, c.LibVer)
+}
+
+// Kill disconnects the client from another connection's goroutine, its own
+// read loop then fails and cleans up. Killing yourself waits for the reply.
+func (c *Client) Kill(self bool) {
+	if self {
+		c.setFlag(ClientCloseAfterReply, true)
+		return
+	}
+	c.Conn.Close()
+}
+
+// WriteReply encodes a reply into the client's output queue using the
+// protocol version of the connection, nothing reaches the socket until Flush
+// is called at the end of the batch.
+func (c *Client) WriteReply(v Reply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the master doesn't read replies to the commands it streams to us, and
+	// CLIENT REPLY can turn them off for anyone else
+	if c.flags&(ClientMaster|ClientReplyOff|ClientReplySkip) != 0 || c.closing {
+		return nil
+	}
+
+	c.protocol.writeReply(&c.out, c.Proto, v)
+	c.checkOutputLimitLocked()
+	return nil
+}
+
+// WritePush queues an out of band message, a pub/sub message or an
+// invalidation, these still arrive while CLIENT REPLY is OFF
+func (c *Client) WritePush(v Push) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.flags&ClientMaster != 0 || c.closing {
+		return nil
+	}
+
+	c.protocol.writeReply(&c.out, c.Proto, v)
+	c.checkOutputLimitLocked()
+	return nil
+}
+
+// commandDone runs after every command, CLIENT REPLY SKIP drops the reply of
+// exactly the one command that follows it
+func (c *Client) commandDone() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flags &^= ClientReplySkip
+	if c.flags&ClientReplySkipNext != 0 {
+		c.flags |= ClientReplySkip
+		c.flags &^= ClientReplySkipNext
+	}
+}
+
+// Write queues raw bytes, for the few things that aren't a RESP reply such as
+// the RDB payload sent after FULLRESYNC.
+func (c *Client) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return 0, net.ErrClosed
+	}
+	c.out.Write(b)
+	c.checkOutputLimitLocked()
+	return len(b), nil
+}
+
+// Flush hands what was queued so far to writeLoop, it doesn't wait for the
+// write. The error is for a connection that is already gone.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return net.ErrClosed
+	}
+	if c.out.Len() > 0 {
+		c.outCond.Signal()
+	}
+	return nil
+}
+
+// writeLoop writes queued output to the socket until the client is closed
+func (c *Client) writeLoop() {
+	defer close(c.outDone)
+
+	var buf []byte
+	for {
+		c.mu.Lock()
+		for c.out.Len() == 0 && !c.closing {
+			c.outCond.Wait()
+		}
+		if c.out.Len() == 0 {
+			c.mu.Unlock()
+			return
+		}
+		buf = append(buf[:0], c.out.Bytes()...)
+		c.out.Reset()
+		c.inFlight = len(buf)
+		c.mu.Unlock()
+
+		_, err := c.Conn.Write(buf)
+
+		c.mu.Lock()
+		c.inFlight = 0
+		if err != nil {
+			c.closing = true
+			c.out.Reset()
+			c.mu.Unlock()
+			c.Conn.Close()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// closeOutput stops accepting output and waits for writeLoop to write what is
+// left, for at most drainTimeout, before the connection gets closed
+func (c *Client) closeOutput() {
+	c.mu.Lock()
+	c.closing = true
+	c.outCond.Signal()
+	c.mu.Unlock()
+
+	c.Conn.SetWriteDeadline(time.Now().Add(drainTimeout))
+	<-c.outDone
+}
+
+// checkOutputLimitLocked disconnects the client when its pending output goes
+// over the client-output-buffer-limit of its class. The master link is never
+// limited, we don't send it replies anyway.
+func (c *Client) checkOutputLimitLocked() {
+	class := c.typeLocked()
+	if class == "master" {
+		return
+	}
+
+	limit := c.config.outputBufferLimit(class)
+	used := c.out.Len() + c.inFlight
+
+	over := limit.Hard > 0 && used >= limit.Hard
+	if limit.Soft > 0 && used >= limit.Soft {
+		now := time.Now()
+		if c.softLimitSince.IsZero() {
+			c.softLimitSince = now
+		} else if now.Sub(c.softLimitSince) >= time.Duration(limit.SoftSeconds)*time.Second {
+			over = true
+		}
+	} else {
+		c.softLimitSince = time.Time{}
+	}
+	if !over {
+		return
+	}
+
+	log.Printf("Client %s closed for overcoming of output buffer limits.", c.infoLocked())
+	c.closing = true
+	c.out.Reset()
+	c.outCond.Signal()
+	// the read loop of the client fails on the closed socket and cleans up
+	c.Conn.Close()
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CLIENT LIST | INFO | ID | SETNAME | GETNAME | SETINFO | KILL | PAUSE | UNPAUSE
+// | TRACKING | CACHING | GETREDIR | REPLY | NO-EVICT | NO-TOUCH
+func (h *RedisServer) handleCLIENT(c *Client, args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		if len(args) != 1 {
+			return c.WriteReply(wrongArgsError("client|id"))
+		}
+		return c.WriteReply(Integer(c.ID))
+
+	case "INFO":
+		if len(args) != 1 {
+			return c.WriteReply(wrongArgsError("client|info"))
+		}
+		return c.WriteReply(Verbatim{Format: "txt", Text: c.Info() + "\n"})
+
+	case "LIST":
+		return h.clientList(c, args[1:])
+
+	case "SETNAME":
+		if len(args) != 2 {
+			return c.WriteReply(wrongArgsError("client|setname"))
+		}
+		if !validClientName(args[1]) {
+			return c.WriteReply(ErrorReply("ERR Client names cannot contain spaces, newlines or special characters."))
+		}
+		c.mu.Lock()
+		c.Name = args[1]
+		c.mu.Unlock()
+		return c.WriteReply(OK)
+
+	case "GETNAME":
+		if len(args) != 1 {
+			return c.WriteReply(wrongArgsError("client|getname"))
+		}
+		c.mu.Lock()
+		name := c.Name
+		c.mu.Unlock()
+		if name == "" {
+			return c.WriteReply(NullBulk{})
+		}
+		return c.WriteReply(BulkString(name))
+
+	case "SETINFO":
+		if len(args) != 3 {
+			return c.WriteReply(wrongArgsError("client|setinfo"))
+		}
+		attr := strings.ToLower(args[1])
+		if attr != "lib-name" && attr != "lib-ver" {
+			return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Unrecognized option '%s'", args[1])))
+		}
+		if !validClientName(args[2]) {
+			return c.WriteReply(ErrorReply(fmt.Sprintf("ERR %s cannot contain spaces, newlines or special characters.", attr)))
+		}
+		c.mu.Lock()
+		if attr == "lib-name" {
+			c.LibName = args[2]
+		} else {
+			c.LibVer = args[2]
+		}
+		c.mu.Unlock()
+		return c.WriteReply(OK)
+
+	case "KILL":
+		return h.clientKill(c, args[1:])
+
+	case "PAUSE":
+		return h.clientPause(c, args[1:])
+
+	case "UNPAUSE":
+		if len(args) != 1 {
+			return c.WriteReply(wrongArgsError("client|unpause"))
+		}
+		h.pause.Unpause(pauseByClient)
+		return c.WriteReply(OK)
+
+	case "TRACKING":
+		return h.clientTracking(c, args[1:])
+
+	case "REPLY":
+		if len(args) != 2 {
+			return c.WriteReply(wrongArgsError("client|reply"))
+		}
+		switch strings.ToUpper(args[1]) {
+		case "ON":
+			c.setFlag(ClientReplyOff|ClientReplySkip, false)
+			return c.WriteReply(OK)
+		case "OFF":
+			c.setFlag(ClientReplyOff, true)
+			return nil
+		case "SKIP":
+			if !c.hasFlag(ClientReplyOff) {
+				c.setFlag(ClientReplySkipNext, true)
+			}
+			return nil
+		}
+		return c.WriteReply(ErrorReply("ERR syntax error"))
+
+	case "NO-EVICT", "NO-TOUCH":
+		name := strings.ToLower(args[0])
+		if len(args) != 2 {
+			return c.WriteReply(wrongArgsError("client|" + name))
+		}
+		flag := ClientNoEvict
+		if name == "no-touch" {
+			flag = ClientNoTouch
+		}
+		switch strings.ToUpper(args[1]) {
+		case "ON":
+			c.setFlag(flag, true)
+		case "OFF":
+			c.setFlag(flag, false)
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+		return c.WriteReply(OK)
+
+	case "CACHING":
+		return h.clientCaching(c, args[1:])
+
+	case "GETREDIR":
+		if len(args) != 1 {
+			return c.WriteReply(wrongArgsError("client|getredir"))
+		}
+		c.mu.Lock()
+		redir := int64(-1)
+		if c.flags&ClientTracking != 0 {
+			redir = c.trackingRedirect
+		}
+		c.mu.Unlock()
+		return c.WriteReply(Integer(redir))
+	}
+
+	return c.WriteReply(ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0])))
+}
+
+// normalizeClientType accepts slave as the old name for replica
+func normalizeClientType(t string) (string, bool) {
+	switch strings.ToLower(t) {
+	case "normal":
+		return "normal", true
+	case "master":
+		return "master", true
+	case "replica", "slave":
+		return "replica", true
+	case "pubsub":
+		return "pubsub", true
+	}
+	return "", false
+}
+
+// CLIENT LIST [TYPE normal|master|replica|pubsub] [ID id [id ...]]
+func (h *RedisServer) clientList(c *Client, args []string) error {
+	clientType := ""
+	var ids map[int64]bool
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return c.WriteReply(ErrorReply("ERR syntax error"))
+			}
+			t, ok := normalizeClientType(args[i+1])
+			if !ok {
+				return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Unknown client type '%s'", args[i+1])))
+			}
+			clientType = t
+			i++
+		case "ID":
+			if i+1 >= len(args) {
+				return c.WriteReply(ErrorReply("ERR syntax error"))
+			}
+			ids = make(map[int64]bool)
+			for i+1 < len(args) {
+				id, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					break
+				}
+				if id <= 0 {
+					return c.WriteReply(ErrorReply("ERR Invalid client ID"))
+				}
+				ids[id] = true
+				i++
+			}
+			if len(ids) == 0 {
+				return c.WriteReply(ErrorReply("ERR Invalid client ID"))
+			}
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	var b strings.Builder
+	for _, client := range h.Clients() {
+		if clientType != "" && client.Type() != clientType {
+			continue
+		}
+		if ids != nil && !ids[client.ID] {
+			continue
+		}
+		b.WriteString(client.Info())
+		b.WriteByte('\n')
+	}
+	return c.WriteReply(Verbatim{Format: "txt", Text: b.String()})
+}
+
+// CLIENT KILL addr:port, or the filter form
+// CLIENT KILL [ID id] [TYPE type] [ADDR addr] [LADDR addr] [USER user] [SKIPME yes|no] [MAXAGE secs]
+func (h *RedisServer) clientKill(c *Client, args []string) error {
+	if len(args) == 0 {
+		return c.WriteReply(wrongArgsError("client|kill"))
+	}
+
+	// the old form takes just an address and answers OK or an error
+	if len(args) == 1 {
+		for _, client := range h.Clients() {
+			if client.Addr == args[0] {
+				client.Kill(client == c)
+				return c.WriteReply(OK)
+			}
+		}
+		return c.WriteReply(ErrorReply("ERR No such client"))
+	}
+
+	if len(args)%2 != 0 {
+		return c.WriteReply(ErrorReply("ERR syntax error"))
+	}
+
+	var id int64
+	var clientType, addr, laddr, user string
+	var maxAge int64
+	skipMe := true
+
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return c.WriteReply(ErrorReply("ERR client-id should be greater than 0"))
+			}
+			id = n
+		case "TYPE":
+			t, ok := normalizeClientType(value)
+			if !ok {
+				return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Unknown client type '%s'", value)))
+			}
+			clientType = t
+		case "ADDR":
+			addr = value
+		case "LADDR":
+			laddr = value
+		case "USER":
+			user = value
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return c.WriteReply(ErrorReply("ERR syntax error"))
+			}
+		case "MAXAGE":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n < 0 {
+				return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+			}
+			maxAge = n
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	killed := 0
+	for _, client := range h.Clients() {
+		if id != 0 && client.ID != id {
+			continue
+		}
+		if clientType != "" && client.Type() != clientType {
+			continue
+		}
+		if addr != "" && client.Addr != addr {
+			continue
+		}
+		if laddr != "" && client.LAddr != laddr {
+			continue
+		}
+		if user != "" && client.User != user {
+			continue
+		}
+		if maxAge != 0 && int64(time.Since(client.Created).Seconds()) < maxAge {
+			continue
+		}
+		if client == c && skipMe {
+			continue
+		}
+		client.Kill(client == c)
+		killed++
+	}
+	return c.WriteReply(Integer(killed))
+}
+
+// CLIENT PAUSE timeout [WRITE|ALL]
+func (h *RedisServer) clientPause(c *Client, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return c.WriteReply(wrongArgsError("client|pause"))
+	}
+
+	timeout, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return c.WriteReply(ErrorReply("ERR timeout is not an integer or out of range"))
+	}
+	if timeout < 0 {
+		return c.WriteReply(ErrorReply("ERR timeout is negative"))
+	}
+
+	all := true
+	if len(args) == 2 {
+		switch strings.ToUpper(args[1]) {
+		case "ALL":
+		case "WRITE":
+			all = false
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	h.pause.Pause(pauseByClient, time.Now().Add(time.Duration(timeout)*time.Millisecond), all)
+	return c.WriteReply(OK)
+}
+
+// CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix [PREFIX prefix ...]]
+// [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+func (h *RedisServer) clientTracking(c *Client, args []string) error {
+	if len(args) == 0 {
+		return c.WriteReply(wrongArgsError("client|tracking"))
+	}
+
+	var redirect int64
+	var options ClientFlag
+	var prefixes []string
+
+	for i := 1; i < len(args); i++ {
+		moreArgs := i+1 < len(args)
+		switch strings.ToUpper(args[i]) {
+		case "REDIRECT":
+			if !moreArgs {
+				return c.WriteReply(ErrorReply("ERR syntax error"))
+			}
+			i++
+			if redirect != 0 {
+				return c.WriteReply(ErrorReply("ERR A client can only redirect to a single other client"))
+			}
+			id, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+			}
+			// the target may still go away later, this is just a sanity check
+			if h.lookupClient(id) == nil {
+				return c.WriteReply(ErrorReply("ERR The client ID you want redirect to does not exist"))
+			}
+			redirect = id
+		case "BCAST":
+			options |= ClientTrackingBcast
+		case "OPTIN":
+			options |= ClientTrackingOptIn
+		case "OPTOUT":
+			options |= ClientTrackingOptOut
+		case "NOLOOP":
+			options |= ClientTrackingNoLoop
+		case "PREFIX":
+			if !moreArgs {
+				return c.WriteReply(ErrorReply("ERR syntax error"))
+			}
+			i++
+			prefixes = append(prefixes, args[i])
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "ON":
+		if len(prefixes) > 0 && options&ClientTrackingBcast == 0 {
+			return c.WriteReply(ErrorReply("ERR PREFIX option requires BCAST mode to be enabled"))
+		}
+
+		c.mu.Lock()
+		current := c.flags
+		c.mu.Unlock()
+
+		if current&ClientTracking != 0 && current&ClientTrackingBcast != options&ClientTrackingBcast {
+			return c.WriteReply(ErrorReply("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."))
+		}
+		if options&ClientTrackingBcast != 0 && options&(ClientTrackingOptIn|ClientTrackingOptOut) != 0 {
+			return c.WriteReply(ErrorReply("ERR OPTIN and OPTOUT are not compatible with BCAST"))
+		}
+		if options&ClientTrackingOptIn != 0 && options&ClientTrackingOptOut != 0 {
+			return c.WriteReply(ErrorReply("ERR You can't use both OPTIN and OPTOUT"))
+		}
+		if (options&ClientTrackingOptIn != 0 && current&ClientTrackingOptOut != 0) ||
+			(options&ClientTrackingOptOut != 0 && current&ClientTrackingOptIn != 0) {
+			return c.WriteReply(ErrorReply("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode."))
+		}
+		if options&ClientTrackingBcast != 0 {
+			if prefix, other, ok := c.prefixCollision(prefixes); ok {
+				return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)))
+			}
+		}
+
+		h.enableTracking(c, redirect, options, prefixes)
+
+	case "OFF":
+		h.disableTracking(c)
+
+	default:
+		return c.WriteReply(ErrorReply("ERR syntax error"))
+	}
+
+	return c.WriteReply(OK)
+}
+
+// CLIENT CACHING YES|NO, decides whether the next command is tracked in OPTIN
+// and OPTOUT mode
+func (h *RedisServer) clientCaching(c *Client, args []string) error {
+	if len(args) != 1 {
+		return c.WriteReply(wrongArgsError("client|caching"))
+	}
+
+	c.mu.Lock()
+	flags := c.flags
+	c.mu.Unlock()
+
+	if flags&ClientTracking == 0 {
+		return c.WriteReply(ErrorReply("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"))
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "YES":
+		if flags&ClientTrackingOptIn == 0 {
+			return c.WriteReply(ErrorReply("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."))
+		}
+	case "NO":
+		if flags&ClientTrackingOptOut == 0 {
+			return c.WriteReply(ErrorReply("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."))
+		}
+	default:
+		return c.WriteReply(ErrorReply("ERR syntax error"))
+	}
+	c.setFlag(ClientTrackingCaching, true)
+	return c.WriteReply(OK)
+}
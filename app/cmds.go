@@ -4,188 +4,441 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
-	"net"
-	"os"
-	"path/filepath"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 )
 
-type CommandFunc func(conn net.Conn, args []string) error
-
-func (h *RedisServer) ExecuteCmd(conn net.Conn, cmd string, args []string) error {
-	var fn CommandFunc
-	switch cmd {
-	case "PING":
-		fn = h.handlePING
-	case "ECHO":
-		fn = h.handleECHO
-	case "SET":
-		fn = h.handleSET
-	case "GET":
-		fn = h.handleGET
-	case "CONFIG":
-		fn = h.handleCONFIG
-	case "KEYS":
-		fn = h.handleKEY
-	case "INFO":
-		fn = h.handleINFO
-	case "REPLCONF":
-		fn = h.handleREPLCONF
-	case "PSYNC":
-		fn = h.handlePSYNC
-	case "WAIT":
-		fn = h.handleWAIT
+type CommandFunc func(c *Client, args []string) error
 
-	default:
-		{
-			log.Printf("Unknown command: %s", cmd)
-			_, cmdErr := conn.Write([]byte("-ERR unknown command\r\n"))
-			if cmdErr != nil {
-				return fmt.Errorf("error handling command %s: %v", cmd, cmdErr)
-			}
-		}
+// ExecuteCmd runs a command from any client, including the master link of a
+// replica, and propagates it to our replicas if it was a write.
+func (h *RedisServer) ExecuteCmd(c *Client, cmd string, args []string) error {
+	defer c.commandDone()
+
+	command, ok := h.lookupCommand(cmd)
+	if !ok {
+		log.Printf("Unknown command: %s", cmd)
+		return c.WriteReply(unknownCommandError(cmd, args))
 	}
 
-	return fn(conn, args)
-}
+	argc := len(args) + 1
+	if (command.Arity > 0 && argc != command.Arity) || argc < -command.Arity {
+		return c.WriteReply(wrongArgsError(command.Name))
+	}
 
-func (h *RedisServer) handleWAIT(conn net.Conn, args []string) error {
-	_, err := conn.Write([]byte(h.protocol.intToIntString(len(h.replica))))
-	return err
-}
+	if !h.isAuthenticated(c) && command.Flags&CmdNoAuth == 0 {
+		return c.WriteReply(ErrorReply("NOAUTH Authentication required."))
+	}
 
-func (h *RedisServer) handlePING(conn net.Conn, args []string) error {
-	_, err := conn.Write([]byte(h.protocol.stringToSimpleString("PONG")))
-	return err
-}
+	if c.inPubSubContext() && !pubsubContextCommands[command.Name] {
+		return c.WriteReply(pubsubContextError(command.Name))
+	}
 
-func (h *RedisServer) handleECHO(conn net.Conn, args []string) error {
-	_, err := conn.Write([]byte(h.protocol.stringToBulkString(args[0])))
-	return err
-}
+	if command.IsWrite() && h.config.Role == "slave" && !c.hasFlag(ClientMaster) {
+		return c.WriteReply(ErrorReply("READONLY You can't write against a read only replica."))
+	}
 
-func (h *RedisServer) handleSET(conn net.Conn, args []string) error {
-	key := args[0]
-	value := args[1]
-	var expiry int64
-	var expire_time int
+	name := command.Name
+	if command.Container && len(args) > 0 {
+		name += "|" + strings.ToLower(args[0])
+	}
+	h.waitForUnpause(c, command, name)
 
-	if len(args) > 2 {
-		expire_time, _ = strconv.Atoi(args[3])
+	c.beginCommand(name, args)
+	defer c.endCommand()
+
+	// blocked clients are left alone by the idle timeout
+	if command.Flags&CmdBlocking != 0 {
+		c.setFlag(ClientBlocked, true)
+		defer c.setFlag(ClientBlocked, false)
 	}
 
-	if expire_time != 0 {
-		milli := time.Now().UnixMilli()
-		expiry = milli + int64(expire_time)
+	dirty := c.dirty
+	c.propagate = nil
+	err := command.Handler(c, args)
+
+	if command.Flags&CmdReadonly != 0 {
+		h.trackingRememberKeys(c, command, args)
+	}
+	// CLIENT CACHING only covers the command that follows it
+	if name != "client|caching" {
+		c.setFlag(ClientTrackingCaching, false)
 	}
 
-	h.ram.Set(key, value, expiry)
+	// only writes that changed something reach the replicas, in the form the
+	// handler asked for if it rewrote the command
+	if command.IsWrite() && h.config.Role == "master" && c.dirty != dirty {
+		argv := c.propagate
+		if argv == nil {
+			argv = append([]string{cmd}, args...)
+		}
+		h.propagateWrite(h.replica, argv)
+	}
 
-	_, err := conn.Write([]byte(h.protocol.stringToSimpleString("OK")))
 	return err
 }
 
-func (s *RedisServer) handleGET(conn net.Conn, args []string) error {
-	if len(args) != 1 {
-		_, err := conn.Write([]byte("-ERR wrong number of arguments for 'get' command\r\n"))
-		return err
+func (h *RedisServer) isAuthenticated(c *Client) bool {
+	return c.Authenticated || h.config.RequirePass == ""
+}
+
+// checkPassword validates credentials for the default user, the only user
+// this server knows about. Without requirepass it accepts any password, the
+// same as a default user with nopass in Redis.
+func (h *RedisServer) checkPassword(username string, password string) bool {
+	if username != "default" {
+		return false
 	}
+	return h.config.RequirePass == "" || password == h.config.RequirePass
+}
 
-	if s.config.Dir != "" && s.config.DBFilename != "" {
-		fileName := filepath.Join(s.config.Dir, s.config.DBFilename)
-		_, err := s.rdb.loadRdbFile(fileName)
-		if err != nil {
-			return err
-		}
+func (h *RedisServer) handleAUTH(c *Client, args []string) error {
+	var username, password string
+	switch len(args) {
+	case 1:
+		username, password = "default", args[0]
+	case 2:
+		username, password = args[0], args[1]
+	default:
+		return c.WriteReply(ErrorReply("ERR syntax error"))
 	}
 
-	key := args[0]
-	value, exists := s.ram.Get(key)
-	if !exists {
-		_, err := conn.Write([]byte("$-1\r\n"))
-		return err
-	} else {
-		_, err := conn.Write([]byte(s.protocol.stringToBulkString(value)))
-		return err
+	if len(args) == 1 && h.config.RequirePass == "" {
+		return c.WriteReply(ErrorReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+	}
+
+	if !h.checkPassword(username, password) {
+		return c.WriteReply(ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
 	}
+
+	c.Authenticated = true
+	return c.WriteReply(OK)
 }
 
-func (h *RedisServer) handleCONFIG(conn net.Conn, args []string) error {
-	cmd := args[0]
-	switch cmd {
-	case "GET":
-		param := args[1]
-		var value string
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (h *RedisServer) handleHELLO(c *Client, args []string) error {
+	proto := c.Proto
 
-		// move this into config.go
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.WriteReply(ErrorReply("ERR Protocol version is not an integer or out of range"))
+		}
+		if ver < 2 || ver > 3 {
+			return c.WriteReply(ErrorReply("NOPROTO unsupported protocol version"))
+		}
+		proto = ver
+	}
 
-		h.config.mu.RLock()
+	var name string
+	setName := false
+	authenticated := false
 
-		switch param {
-		case "dir":
-			value = h.config.Dir
-		case "dbfilename":
-			value = h.config.DBFilename
+	for i := 1; i < len(args); i++ {
+		moreArgs := len(args) - 1 - i
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if moreArgs < 2 {
+				return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])))
+			}
+			if !h.checkPassword(args[i+1], args[i+2]) {
+				return c.WriteReply(ErrorReply("WRONGPASS invalid username-password pair or user is disabled."))
+			}
+			authenticated = true
+			i += 2
+		case "SETNAME":
+			if moreArgs < 1 {
+				return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])))
+			}
+			if !validClientName(args[i+1]) {
+				return c.WriteReply(ErrorReply("ERR Client names cannot contain spaces, newlines or special characters."))
+			}
+			name = args[i+1]
+			setName = true
+			i++
 		default:
-			h.config.mu.RUnlock()
-			return fmt.Errorf("unknown config parameter: %s", param)
+			return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", args[i])))
 		}
+	}
 
-		_, err := conn.Write([]byte(h.protocol.stringToArray([]string{param, value})))
+	if authenticated {
+		c.Authenticated = true
+	}
+	if !h.isAuthenticated(c) {
+		return c.WriteReply(ErrorReply("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+	}
+	c.mu.Lock()
+	if setName {
+		c.Name = name
+	}
+	c.Proto = proto
+	c.mu.Unlock()
+
+	return c.WriteReply(Map{
+		BulkString("server"), BulkString("redis"),
+		BulkString("version"), BulkString("7.2.0"),
+		BulkString("proto"), Integer(proto),
+		BulkString("id"), Integer(c.ID),
+		BulkString("mode"), BulkString("standalone"),
+		BulkString("role"), BulkString(h.config.Role),
+		BulkString("modules"), Array{},
+	})
+}
 
-		h.config.mu.RUnlock()
+func (h *RedisServer) handleWAIT(c *Client, args []string) error {
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+	timeout, err := strconv.Atoi(args[1])
+	if err != nil {
+		return c.WriteReply(ErrorReply("ERR timeout is not an integer or out of range"))
+	}
+	if timeout < 0 {
+		return c.WriteReply(ErrorReply("ERR timeout is negative"))
+	}
 
-		return err
+	h.replicasMu.RLock()
+	replicas := len(h.replica)
+	h.replicasMu.RUnlock()
+	return c.WriteReply(Integer(replicas))
+}
+
+func (h *RedisServer) handlePING(c *Client, args []string) error {
+	if len(args) <= 1 && c.inPubSubContext() {
+		return c.WriteReply(pubsubPing(args))
+	}
+	switch len(args) {
+	case 0:
+		return c.WriteReply(SimpleString("PONG"))
+	case 1:
+		return c.WriteReply(BulkString(args[0]))
 	}
-	return nil
+	return c.WriteReply(wrongArgsError("ping"))
+}
+
+func (h *RedisServer) handleECHO(c *Client, args []string) error {
+	return c.WriteReply(BulkString(args[0]))
 }
 
-func (s *RedisServer) handleKEY(conn net.Conn, args []string) error {
-	if len(os.Args) < 5 {
-		return fmt.Errorf("insufficient arguments, need dir and dbfilename")
+// setOptions is the parsed tail of SET or GETEX, expiry is absolute unix millis
+type setOptions struct {
+	nx, xx, get, keepTTL bool
+	persist              bool // GETEX only, drops the TTL
+	expiry               int64
+	relative             bool // EX or PX, rewritten to PXAT for the replicas
+}
+
+// parseSetOptions follows the grammar of SET in Redis: NX and XX exclude each
+// other, and so do KEEPTTL, EX, PX, EXAT and PXAT, but repeating the same one
+// is fine and the last value wins. GETEX shares the expiry options and adds
+// PERSIST, command is the name errors mention and says which one it is.
+func parseSetOptions(args []string, command string) (setOptions, ErrorReply) {
+	var opts setOptions
+	unit := ""
+	set := command == "set"
+
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		moreArgs := i+1 < len(args)
+
+		switch {
+		case opt == "NX" && set && !opts.xx:
+			opts.nx = true
+		case opt == "XX" && set && !opts.nx:
+			opts.xx = true
+		case opt == "GET" && set:
+			opts.get = true
+		case opt == "KEEPTTL" && set && unit == "":
+			opts.keepTTL = true
+		case opt == "PERSIST" && !set && unit == "":
+			opts.persist = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") &&
+			!opts.keepTTL && !opts.persist && (unit == "" || unit == opt) && moreArgs:
+			unit = opt
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return opts, ErrorReply("ERR value is not an integer or out of range")
+			}
+			expiry, ok := expireAt(unit, n, time.Now().UnixMilli())
+			if !ok {
+				return opts, invalidExpireError(command)
+			}
+			opts.expiry = expiry
+			opts.relative = unit == "EX" || unit == "PX"
+		default:
+			return opts, ErrorReply("ERR syntax error")
+		}
 	}
+	return opts, ""
+}
+
+func invalidExpireError(command string) ErrorReply {
+	return ErrorReply(fmt.Sprintf("ERR invalid expire time in '%s' command", command))
+}
 
-	if s.config.Dir == "" && s.config.DBFilename == "" {
-		fmt.Errorf("there needs to be a dir and dbfilename")
+// expireAt turns an EX, PX, EXAT or PXAT argument into unix millis, false when
+// it isn't positive or doesn't fit
+func expireAt(unit string, n int64, now int64) (int64, bool) {
+	if n <= 0 {
+		return 0, false
+	}
+	if unit == "EX" || unit == "EXAT" {
+		if n > math.MaxInt64/1000 {
+			return 0, false
+		}
+		n *= 1000
+	}
+	if unit == "EX" || unit == "PX" {
+		if n > math.MaxInt64-now {
+			return 0, false
+		}
+		n += now
 	}
+	return n, true
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds |
+// EXAT unix-time-seconds | PXAT unix-time-milliseconds | KEEPTTL]
+func (h *RedisServer) handleSET(c *Client, args []string) error {
+	key := args[0]
+	value := args[1]
 
-	fileName := filepath.Join(s.config.Dir, s.config.DBFilename)
+	opts, errReply := parseSetOptions(args[2:], "set")
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
 
-	keys_added, err := s.rdb.loadRdbFile(fileName)
+	old, existed, op := h.setGeneric(c, key, value, opts)
 
-	if err != nil {
-		return err
+	switch {
+	case opts.get && existed:
+		return c.WriteReply(BulkString(old))
+	case opts.get, op == mutateNone:
+		return c.WriteReply(NullBulk{})
 	}
+	return c.WriteReply(OK)
+}
 
-	_, err = conn.Write([]byte(s.protocol.stringToArray(keys_added)))
-	if err != nil {
-		return err
+// setGeneric is SET and the commands that are variants of it, it returns the
+// value key had before and whether the new one was written
+func (h *RedisServer) setGeneric(c *Client, key, value string, opts setOptions) (string, bool, mutation) {
+	var old string
+	var existed bool
+	op := h.mutateKey(c, key, func(cur string, expiry int64, exists bool) (string, int64, mutation) {
+		old, existed = cur, exists
+		if (opts.nx && exists) || (opts.xx && !exists) {
+			return "", 0, mutateNone
+		}
+		if opts.keepTTL {
+			return value, expiry, mutateSet
+		}
+		return value, opts.expiry, mutateSet
+	})
+
+	if op == mutateSet && opts.relative {
+		c.propagate = []string{"SET", key, value, "PXAT", strconv.FormatInt(opts.expiry, 10)}
 	}
-	return nil
+	return old, existed, op
 }
-func (h *RedisServer) handleINFO(conn net.Conn, args []string) error {
-	_, err := conn.Write([]byte((h.protocol.stringToBulkString(h.getConfig()))))
-	return (err)
+
+func (s *RedisServer) handleGET(c *Client, args []string) error {
+	key := args[0]
+	value, exists := s.lookupKey(c, key)
+	if !exists {
+		return c.WriteReply(NullBulk{})
+	} else {
+		return c.WriteReply(BulkString(value))
+	}
 }
 
-func (h *RedisServer) handleREPLCONF(conn net.Conn, args []string) error {
+// OBJECT IDLETIME key, reading it doesn't count as an access
+func (h *RedisServer) handleOBJECT(c *Client, args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case "IDLETIME":
+		if len(args) != 2 {
+			return c.WriteReply(wrongArgsError("object|idletime"))
+		}
+		idle, ok := h.ram.IdleTime(args[1])
+		if !ok {
+			return c.WriteReply(NullBulk{})
+		}
+		return c.WriteReply(Integer(int64(idle.Seconds())))
+	}
+	return c.WriteReply(ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try OBJECT HELP.", args[0])))
+}
 
-	// Get client ID from connection
-	clientID := conn.RemoteAddr().String()
+// CONFIG GET parameter [parameter ...], parameters may be glob patterns
+func (h *RedisServer) handleCONFIG(c *Client, args []string) error {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		if len(args) < 2 {
+			return c.WriteReply(wrongArgsError("config|get"))
+		}
 
-	// Register this connection as a replica
-	h.AddReplica(clientID, conn)
+		reply := Map{}
+		for _, param := range configParams {
+			for _, pattern := range args[1:] {
+				if stringMatch(strings.ToLower(pattern), param) {
+					value, _ := h.config.Get(param)
+					reply = append(reply, BulkString(param), BulkString(value))
+					break
+				}
+			}
+		}
+		return c.WriteReply(reply)
+	}
+	return c.WriteReply(ErrorReply(fmt.Sprintf("ERR unknown subcommand '%s'. Try CONFIG HELP.", args[0])))
+}
 
-	_, err := conn.Write([]byte(h.protocol.stringToSimpleString("OK")))
-	return err
+func (s *RedisServer) handleKEY(c *Client, args []string) error {
+	return c.WriteReply(BulkStrings(s.ram.Keys(args[0])))
 }
-func (h *RedisServer) handlePSYNC(conn net.Conn, args []string) error {
-	_, err := conn.Write([]byte("+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n"))
-	if err != nil {
-		return nil
+func (h *RedisServer) handleINFO(c *Client, args []string) error {
+	section := ""
+	if len(args) > 0 {
+		section = args[0]
+	}
+	return c.WriteReply(Verbatim{Format: "txt", Text: h.getConfig(section)})
+}
+
+func (h *RedisServer) handleREPLCONF(c *Client, args []string) error {
+	if len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "GETACK":
+			// sent by our master, the only REPLCONF a master ever expects an answer to
+			return h.sendACK(c)
+		case "ACK":
+			// replicas reporting their offset don't get a reply
+			if len(args) > 1 {
+				if offset, err := strconv.Atoi(args[1]); err == nil {
+					c.mu.Lock()
+					c.replAckOffset = offset
+					c.mu.Unlock()
+				}
+			}
+			return nil
+		}
 	}
 
+	return c.WriteReply(OK)
+}
+func (h *RedisServer) handlePSYNC(c *Client, args []string) error {
+	// the replica is registered under the same lock propagateWrite holds, so
+	// the offset in FULLRESYNC is exactly where its stream starts
+	h.replicasMu.Lock()
+	defer h.replicasMu.Unlock()
+
+	h.config.mu.RLock()
+	offset := h.config.MasterReplOffset
+	h.config.mu.RUnlock()
+
+	c.WriteReply(SimpleString(fmt.Sprintf("FULLRESYNC %s %d", h.config.MasterReplid, offset)))
+	h.replica[c.Addr] = c
+	c.setFlag(ClientReplica, true)
+
 	emptyRDBBase64 := "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
 	emptyRDB, err := base64.StdEncoding.DecodeString(emptyRDBBase64)
 	if err != nil {
@@ -194,28 +447,69 @@ func (h *RedisServer) handlePSYNC(conn net.Conn, args []string) error {
 
 	// Send the RDB file header (length)
 	rdbHeader := fmt.Sprintf("$%d\r\n", len(emptyRDB))
-	_, err = conn.Write([]byte(rdbHeader))
+	_, err = c.Write([]byte(rdbHeader))
 	if err != nil {
 		return err
 	}
 
 	// Send the RDB file content (without any additional \r\n)
-	_, err = conn.Write(emptyRDB)
+	_, err = c.Write(emptyRDB)
 	if err != nil {
 		return err
 	}
 	return err
 }
 
-func (h *RedisServer) getConfig() string {
-	ret := ""
+// getConfig builds the INFO text, section is empty or "all" for everything
+func (h *RedisServer) getConfig(section string) string {
+	section = strings.ToLower(section)
+	want := func(name string) bool {
+		return section == "" || section == "all" || section == "default" || section == "everything" || section == name
+	}
+
+	var sections []string
+
+	if want("server") {
+		sections = append(sections, strings.Join([]string{
+			"# Server",
+			fmt.Sprintf("tcp_port:%s", h.config.Port),
+		}, "\r\n"))
+	}
+
+	if want("clients") {
+		sections = append(sections, strings.Join([]string{
+			"# Clients",
+			fmt.Sprintf("connected_clients:%d", h.connectedClients.Load()),
+			fmt.Sprintf("maxclients:%d", h.config.MaxClients),
+		}, "\r\n"))
+	}
+
+	if want("stats") {
+		sections = append(sections, strings.Join([]string{
+			"# Stats",
+			fmt.Sprintf("total_connections_received:%d", h.totalConnections.Load()),
+			fmt.Sprintf("rejected_connections:%d", h.rejectedConnections.Load()),
+		}, "\r\n"))
+	}
+
+	if want("replication") {
+		h.config.mu.RLock()
+		offset := h.config.MasterReplOffset
+		h.config.mu.RUnlock()
 
-	ret += fmt.Sprintf("role:%s", h.config.Role)
-	ret += fmt.Sprintf("address:%s", h.config.Addr)
-	ret += fmt.Sprintf("master_address:%s", h.config.MasterAddr)
-	ret += fmt.Sprintf("master_replid:%s", h.config.MasterReplid)
-	ret += fmt.Sprintf("master_repl_offset:%d", h.config.MasterReplOffset)
-	ret += fmt.Sprintf("connected_slaves:%d", h.config.ConnectedReplicas)
+		h.replicasMu.RLock()
+		replicas := len(h.replica)
+		h.replicasMu.RUnlock()
+
+		sections = append(sections, strings.Join([]string{
+			"# Replication",
+			fmt.Sprintf("role:%s", h.config.Role),
+			fmt.Sprintf("master_address:%s", h.config.MasterAddr),
+			fmt.Sprintf("master_replid:%s", h.config.MasterReplid),
+			fmt.Sprintf("master_repl_offset:%d", offset),
+			fmt.Sprintf("connected_slaves:%d", replicas),
+		}, "\r\n"))
+	}
 
-	return ret
+	return strings.Join(sections, "\r\n\r\n") + "\r\n"
 }
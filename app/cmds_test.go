@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSetOptions(t *testing.T) {
+	tests := []struct {
+		command string
+		args    string
+		want    setOptions
+		ttl     int64 // expected expiry relative to now for EX and PX
+		wantErr string
+	}{
+		{command: "set", args: "", want: setOptions{}},
+		{command: "set", args: "NX", want: setOptions{nx: true}},
+		{command: "set", args: "xx", want: setOptions{xx: true}},
+		{command: "set", args: "NX NX", want: setOptions{nx: true}},
+		{command: "set", args: "NX XX", wantErr: "ERR syntax error"},
+		{command: "set", args: "XX NX", wantErr: "ERR syntax error"},
+		{command: "set", args: "GET", want: setOptions{get: true}},
+		// allowed together since Redis 7.0, the old value comes back and
+		// nothing is written when the key exists
+		{command: "set", args: "GET NX", want: setOptions{get: true, nx: true}},
+		{command: "set", args: "NX GET", want: setOptions{get: true, nx: true}},
+		{command: "set", args: "XX GET", want: setOptions{get: true, xx: true}},
+		{command: "set", args: "KEEPTTL", want: setOptions{keepTTL: true}},
+		{command: "set", args: "KEEPTTL KEEPTTL", want: setOptions{keepTTL: true}},
+		{command: "set", args: "KEEPTTL EX 10", wantErr: "ERR syntax error"},
+		{command: "set", args: "EX 10 KEEPTTL", wantErr: "ERR syntax error"},
+		{command: "set", args: "EX 10", want: setOptions{relative: true}, ttl: 10000},
+		{command: "set", args: "px 1500", want: setOptions{relative: true}, ttl: 1500},
+		{command: "set", args: "EX 10 EX 20", want: setOptions{relative: true}, ttl: 20000},
+		{command: "set", args: "EX 10 PX 20", wantErr: "ERR syntax error"},
+		{command: "set", args: "EXAT 4102444800", want: setOptions{expiry: 4102444800000}},
+		{command: "set", args: "PXAT 4102444800000", want: setOptions{expiry: 4102444800000}},
+		{command: "set", args: "EXAT 1 PXAT 1", wantErr: "ERR syntax error"},
+		{command: "set", args: "NX EX 10 GET", want: setOptions{nx: true, get: true, relative: true}, ttl: 10000},
+		{command: "set", args: "EX", wantErr: "ERR syntax error"},
+		{command: "set", args: "EX ten", wantErr: "ERR value is not an integer or out of range"},
+		{command: "set", args: "EX 0", wantErr: "ERR invalid expire time in 'set' command"},
+		{command: "set", args: "PX -5", wantErr: "ERR invalid expire time in 'set' command"},
+		{command: "set", args: "EX 9223372036854775807", wantErr: "ERR invalid expire time in 'set' command"},
+		{command: "set", args: "PERSIST", wantErr: "ERR syntax error"},
+		{command: "set", args: "FOO", wantErr: "ERR syntax error"},
+		{command: "getex", args: "PERSIST", want: setOptions{persist: true}},
+		{command: "getex", args: "EX 10", want: setOptions{relative: true}, ttl: 10000},
+		{command: "getex", args: "PERSIST EX 10", wantErr: "ERR syntax error"},
+		{command: "getex", args: "EX 10 PERSIST", wantErr: "ERR syntax error"},
+		{command: "getex", args: "EX 0", wantErr: "ERR invalid expire time in 'getex' command"},
+		{command: "getex", args: "NX", wantErr: "ERR syntax error"},
+		{command: "getex", args: "KEEPTTL", wantErr: "ERR syntax error"},
+		{command: "getex", args: "GET", wantErr: "ERR syntax error"},
+	}
+
+	for _, tt := range tests {
+		now := time.Now().UnixMilli()
+		got, errReply := parseSetOptions(strings.Fields(tt.args), tt.command)
+
+		if tt.wantErr != "" {
+			if string(errReply) != tt.wantErr {
+				t.Errorf("%s %q: error = %q, want %q", tt.command, tt.args, errReply, tt.wantErr)
+			}
+			continue
+		}
+		if errReply != "" {
+			t.Errorf("%s %q: unexpected error %q", tt.command, tt.args, errReply)
+			continue
+		}
+
+		if tt.ttl != 0 {
+			// EX and PX are resolved against the clock, allow for a slow run
+			if got.expiry < now+tt.ttl || got.expiry > now+tt.ttl+1000 {
+				t.Errorf("%s %q: expiry = %d, want about %d", tt.command, tt.args, got.expiry, now+tt.ttl)
+			}
+			got.expiry = 0
+		}
+		if got != tt.want {
+			t.Errorf("%s %q: got %+v, want %+v", tt.command, tt.args, got, tt.want)
+		}
+	}
+}
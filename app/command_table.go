@@ -0,0 +1,440 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type CommandFlag uint32
+
+const (
+	CmdWrite    CommandFlag = 1 << iota // changes the dataset, propagated to replicas
+	CmdReadonly                         // only reads keys, tracked for client side caching
+	CmdAdmin
+	CmdPubSub
+	CmdBlocking
+	CmdLoading // allowed while the dataset is still loading
+	CmdStale   // allowed on a replica whose master link is down
+	CmdFast
+	CmdNoAuth // allowed before the client authenticated
+)
+
+var commandFlagNames = []struct {
+	flag CommandFlag
+	name string
+}{
+	{CmdWrite, "write"},
+	{CmdReadonly, "readonly"},
+	{CmdAdmin, "admin"},
+	{CmdPubSub, "pubsub"},
+	{CmdBlocking, "blocking"},
+	{CmdLoading, "loading"},
+	{CmdStale, "stale"},
+	{CmdFast, "fast"},
+	{CmdNoAuth, "no_auth"},
+}
+
+// Command describes everything the server needs to know about a command
+// besides how to run it. Dispatch, replication and COMMAND all read from it.
+type Command struct {
+	Name    string
+	Handler CommandFunc
+	// Arity counts the command name, a negative value means at least -Arity
+	Arity int
+	Flags CommandFlag
+	// FirstKey, LastKey and Step locate the keys in the arguments, again
+	// counting the command name as 0. LastKey -1 means the last argument and
+	// FirstKey 0 means the command takes no keys.
+	FirstKey int
+	LastKey  int
+	Step     int
+	Group    string
+	Summary  string
+	Since    string
+	// Container commands such as CONFIG are reported with their subcommand,
+	// e.g. config|get
+	Container bool
+}
+
+func (s *RedisServer) buildCommandTable() map[string]*Command {
+	commands := []*Command{
+		{Name: "ping", Handler: s.handlePING, Arity: -1, Flags: CmdFast,
+			Group: "connection", Summary: "Returns the server's liveliness response.", Since: "1.0.0"},
+		{Name: "echo", Handler: s.handleECHO, Arity: 2, Flags: CmdFast,
+			Group: "connection", Summary: "Returns the given string.", Since: "1.0.0"},
+		{Name: "hello", Handler: s.handleHELLO, Arity: -1, Flags: CmdFast | CmdNoAuth | CmdLoading | CmdStale,
+			Group: "connection", Summary: "Handshakes with the Redis server.", Since: "6.0.0"},
+		{Name: "auth", Handler: s.handleAUTH, Arity: -2, Flags: CmdFast | CmdNoAuth | CmdLoading | CmdStale,
+			Group: "connection", Summary: "Authenticates the connection.", Since: "1.0.0"},
+		{Name: "set", Handler: s.handleSET, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", Since: "1.0.0"},
+		{Name: "get", Handler: s.handleGET, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns the string value of a key.", Since: "1.0.0"},
+		{Name: "append", Handler: s.handleAPPEND, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist.", Since: "2.0.0"},
+		{Name: "strlen", Handler: s.handleSTRLEN, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns the length of a string value.", Since: "2.2.0"},
+		{Name: "getrange", Handler: s.handleGETRANGE, Arity: 4, Flags: CmdReadonly, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns a substring of the string stored at a key.", Since: "2.4.0"},
+		{Name: "setrange", Handler: s.handleSETRANGE, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.", Since: "2.2.0"},
+		{Name: "getdel", Handler: s.handleGETDEL, Arity: 2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns the string value of a key after deleting the key.", Since: "6.2.0"},
+		{Name: "getex", Handler: s.handleGETEX, Arity: -2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns the string value of a key after setting its expiration time.", Since: "6.2.0"},
+		{Name: "getset", Handler: s.handleGETSET, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Returns the previous string value of a key after setting it to a new value.", Since: "1.0.0"},
+		{Name: "mget", Handler: s.handleMGET, Arity: -2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: -1, Step: 1,
+			Group: "string", Summary: "Atomically returns the string values of one or more keys.", Since: "1.0.0"},
+		{Name: "mset", Handler: s.handleMSET, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: -1, Step: 2,
+			Group: "string", Summary: "Atomically creates or modifies the string values of one or more keys.", Since: "1.0.1"},
+		{Name: "msetnx", Handler: s.handleMSETNX, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: -1, Step: 2,
+			Group: "string", Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist.", Since: "1.0.1"},
+		{Name: "setnx", Handler: s.handleSETNX, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Set the string value of a key only when the key doesn't exist.", Since: "1.0.0"},
+		{Name: "setex", Handler: s.handleSETEX, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Sets the string value and expiration time of a key. Creates the key if it doesn't exist.", Since: "2.0.0"},
+		{Name: "psetex", Handler: s.handlePSETEX, Arity: 4, Flags: CmdWrite, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Sets both string value and expiration time in milliseconds of a key. The key is created if it doesn't exist.", Since: "2.6.0"},
+		{Name: "lcs", Handler: s.handleLCS, Arity: -3, Flags: CmdReadonly, FirstKey: 1, LastKey: 2, Step: 1,
+			Group: "string", Summary: "Finds the longest common substring.", Since: "7.0.0"},
+		{Name: "incr", Handler: s.handleINCR, Arity: 2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0"},
+		{Name: "decr", Handler: s.handleDECR, Arity: 2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0"},
+		{Name: "incrby", Handler: s.handleINCRBY, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0"},
+		{Name: "decrby", Handler: s.handleDECRBY, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.", Since: "1.0.0"},
+		{Name: "incrbyfloat", Handler: s.handleINCRBYFLOAT, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "string", Summary: "Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.", Since: "2.6.0"},
+		{Name: "del", Handler: s.handleDEL, Arity: -2, Flags: CmdWrite, FirstKey: 1, LastKey: -1, Step: 1,
+			Group: "generic", Summary: "Deletes one or more keys.", Since: "1.0.0"},
+		{Name: "unlink", Handler: s.handleUNLINK, Arity: -2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: -1, Step: 1,
+			Group: "generic", Summary: "Asynchronously deletes one or more keys.", Since: "4.0.0"},
+		{Name: "exists", Handler: s.handleEXISTS, Arity: -2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: -1, Step: 1,
+			Group: "generic", Summary: "Determines whether one or more keys exist.", Since: "1.0.0"},
+		{Name: "touch", Handler: s.handleTOUCH, Arity: -2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: -1, Step: 1,
+			Group: "generic", Summary: "Returns the number of existing keys out of those specified after updating the time they were last accessed.", Since: "3.2.1"},
+		{Name: "type", Handler: s.handleTYPE, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Determines the type of value stored at a key.", Since: "1.0.0"},
+		{Name: "rename", Handler: s.handleRENAME, Arity: 3, Flags: CmdWrite, FirstKey: 1, LastKey: 2, Step: 1,
+			Group: "generic", Summary: "Renames a key and overwrites the destination.", Since: "1.0.0"},
+		{Name: "renamenx", Handler: s.handleRENAMENX, Arity: 3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 2, Step: 1,
+			Group: "generic", Summary: "Renames a key only when the target key name doesn't exist.", Since: "1.0.0"},
+		{Name: "copy", Handler: s.handleCOPY, Arity: -3, Flags: CmdWrite, FirstKey: 1, LastKey: 2, Step: 1,
+			Group: "generic", Summary: "Copies the value of a key to a new key.", Since: "6.2.0"},
+		{Name: "randomkey", Handler: s.handleRANDOMKEY, Arity: 1, Flags: CmdReadonly,
+			Group: "generic", Summary: "Returns a random key name from the database.", Since: "1.0.0"},
+		{Name: "dbsize", Handler: s.handleDBSIZE, Arity: 1, Flags: CmdReadonly | CmdFast,
+			Group: "server", Summary: "Returns the number of keys in the database.", Since: "1.0.0"},
+		{Name: "expire", Handler: s.handleEXPIRE, Arity: -3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key in seconds.", Since: "1.0.0"},
+		{Name: "pexpire", Handler: s.handlePEXPIRE, Arity: -3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key in milliseconds.", Since: "2.6.0"},
+		{Name: "expireat", Handler: s.handleEXPIREAT, Arity: -3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp.", Since: "1.2.0"},
+		{Name: "pexpireat", Handler: s.handlePEXPIREAT, Arity: -3, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp.", Since: "2.6.0"},
+		{Name: "ttl", Handler: s.handleTTL, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Returns the expiration time in seconds of a key.", Since: "1.0.0"},
+		{Name: "pttl", Handler: s.handlePTTL, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Returns the expiration time in milliseconds of a key.", Since: "2.6.0"},
+		{Name: "expiretime", Handler: s.handleEXPIRETIME, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp.", Since: "7.0.0"},
+		{Name: "pexpiretime", Handler: s.handlePEXPIRETIME, Arity: 2, Flags: CmdReadonly | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Returns the expiration time of a key as a Unix milliseconds timestamp.", Since: "7.0.0"},
+		{Name: "persist", Handler: s.handlePERSIST, Arity: 2, Flags: CmdWrite | CmdFast, FirstKey: 1, LastKey: 1, Step: 1,
+			Group: "generic", Summary: "Removes the expiration time of a key.", Since: "2.2.0"},
+		{Name: "keys", Handler: s.handleKEY, Arity: 2, Flags: CmdReadonly,
+			Group: "generic", Summary: "Returns all key names that match a pattern.", Since: "1.0.0"},
+		{Name: "object", Handler: s.handleOBJECT, Arity: -2, Flags: CmdReadonly, FirstKey: 2, LastKey: 2, Step: 1, Container: true,
+			Group: "generic", Summary: "A container for object introspection commands.", Since: "2.2.3"},
+		{Name: "client", Handler: s.handleCLIENT, Arity: -2, Flags: CmdLoading | CmdStale, Container: true,
+			Group: "connection", Summary: "A container for client connection commands.", Since: "2.4.0"},
+		{Name: "config", Handler: s.handleCONFIG, Arity: -2, Flags: CmdAdmin | CmdLoading | CmdStale, Container: true,
+			Group: "server", Summary: "A container for server configuration commands.", Since: "2.0.0"},
+		{Name: "info", Handler: s.handleINFO, Arity: -1, Flags: CmdLoading | CmdStale,
+			Group: "server", Summary: "Returns information and statistics about the server.", Since: "1.0.0"},
+		{Name: "command", Handler: s.handleCOMMAND, Arity: -1, Flags: CmdLoading | CmdStale, Container: true,
+			Group: "server", Summary: "Returns detailed information about all commands.", Since: "2.8.13"},
+		{Name: "replconf", Handler: s.handleREPLCONF, Arity: -1, Flags: CmdAdmin | CmdLoading | CmdStale,
+			Group: "server", Summary: "An internal command for configuring the replication stream.", Since: "3.0.0"},
+		{Name: "psync", Handler: s.handlePSYNC, Arity: -3, Flags: CmdAdmin,
+			Group: "server", Summary: "An internal command used in replication.", Since: "2.8.0"},
+		{Name: "subscribe", Handler: s.handleSUBSCRIBE, Arity: -2, Flags: CmdPubSub | CmdLoading | CmdStale,
+			Group: "pubsub", Summary: "Listens for messages published to channels.", Since: "2.0.0"},
+		{Name: "unsubscribe", Handler: s.handleUNSUBSCRIBE, Arity: -1, Flags: CmdPubSub | CmdLoading | CmdStale,
+			Group: "pubsub", Summary: "Stops listening to messages posted to channels.", Since: "2.0.0"},
+		{Name: "publish", Handler: s.handlePUBLISH, Arity: 3, Flags: CmdPubSub | CmdLoading | CmdStale | CmdFast,
+			Group: "pubsub", Summary: "Posts a message to a channel.", Since: "2.0.0"},
+		{Name: "shutdown", Handler: s.handleSHUTDOWN, Arity: -1, Flags: CmdAdmin | CmdLoading | CmdStale,
+			Group: "server", Summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.", Since: "1.0.0"},
+		{Name: "wait", Handler: s.handleWAIT, Arity: 3, Flags: CmdBlocking,
+			Group: "generic", Summary: "Blocks until the asynchronous replication of all preceding write commands sent by the connection is completed.", Since: "3.0.0"},
+	}
+
+	table := make(map[string]*Command, len(commands))
+	for _, cmd := range commands {
+		table[cmd.Name] = cmd
+	}
+	return table
+}
+
+func (s *RedisServer) lookupCommand(name string) (*Command, bool) {
+	cmd, ok := s.commands[strings.ToLower(name)]
+	return cmd, ok
+}
+
+func (c *Command) IsWrite() bool {
+	return c.Flags&CmdWrite != 0
+}
+
+// getKeys returns the indexes into argv (command name included) that hold
+// keys, this is what cluster routing and ACL key checks would be built on
+func (c *Command) getKeys(argv []string) []int {
+	if c.FirstKey == 0 {
+		return nil
+	}
+
+	last := c.LastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+
+	var keys []int
+	for i := c.FirstKey; i <= last && i < len(argv); i += c.Step {
+		keys = append(keys, i)
+	}
+	return keys
+}
+
+// aclCategories follows the implicit categories Redis derives from the
+// command flags, plus the one for the command's group
+func (c *Command) aclCategories() []string {
+	var cats []string
+	if c.Flags&CmdWrite != 0 {
+		cats = append(cats, "@write")
+	}
+	if c.Flags&CmdReadonly != 0 {
+		cats = append(cats, "@read")
+	}
+	if c.Flags&CmdAdmin != 0 {
+		cats = append(cats, "@admin", "@dangerous")
+	}
+	if c.Flags&CmdPubSub != 0 {
+		cats = append(cats, "@pubsub")
+	}
+	if c.Flags&CmdBlocking != 0 {
+		cats = append(cats, "@blocking")
+	}
+	if c.Flags&CmdFast != 0 {
+		cats = append(cats, "@fast")
+	} else {
+		cats = append(cats, "@slow")
+	}
+
+	switch c.Group {
+	case "string":
+		cats = append(cats, "@string")
+	case "generic":
+		cats = append(cats, "@keyspace")
+	case "connection":
+		cats = append(cats, "@connection")
+	}
+	return cats
+}
+
+func (c *Command) flagNames() []string {
+	var names []string
+	for _, f := range commandFlagNames {
+		if c.Flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// infoReply is one entry of COMMAND and COMMAND INFO
+func (c *Command) infoReply() Reply {
+	flags := Set{}
+	for _, name := range c.flagNames() {
+		flags = append(flags, SimpleString(name))
+	}
+	cats := Set{}
+	for _, cat := range c.aclCategories() {
+		cats = append(cats, SimpleString(cat))
+	}
+
+	keySpecs := Array{}
+	if c.FirstKey != 0 {
+		// lastkey in a key spec is relative to the first key
+		lastKey := c.LastKey
+		if lastKey > 0 {
+			lastKey -= c.FirstKey
+		}
+		access := "RO"
+		if c.IsWrite() {
+			access = "RW"
+		}
+		keySpecs = append(keySpecs, Map{
+			BulkString("flags"), Set{SimpleString(access)},
+			BulkString("begin_search"), Map{
+				BulkString("type"), BulkString("index"),
+				BulkString("spec"), Map{BulkString("index"), Integer(c.FirstKey)},
+			},
+			BulkString("find_keys"), Map{
+				BulkString("type"), BulkString("range"),
+				BulkString("spec"), Map{
+					BulkString("lastkey"), Integer(lastKey),
+					BulkString("keystep"), Integer(c.Step),
+					BulkString("limit"), Integer(0),
+				},
+			},
+		})
+	}
+
+	return Array{
+		BulkString(c.Name),
+		Integer(c.Arity),
+		flags,
+		Integer(c.FirstKey),
+		Integer(c.LastKey),
+		Integer(c.Step),
+		cats,
+		Set{},
+		keySpecs,
+		Array{},
+	}
+}
+
+func (c *Command) docsReply() Reply {
+	return Map{
+		BulkString("summary"), BulkString(c.Summary),
+		BulkString("since"), BulkString(c.Since),
+		BulkString("group"), BulkString(c.Group),
+	}
+}
+
+func (s *RedisServer) sortedCommands() []*Command {
+	cmds := make([]*Command, 0, len(s.commands))
+	for _, cmd := range s.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// COMMAND [COUNT | INFO name... | DOCS name... | LIST [FILTERBY ...] | GETKEYS cmd args...]
+func (s *RedisServer) handleCOMMAND(c *Client, args []string) error {
+	if len(args) == 0 {
+		all := Array{}
+		for _, cmd := range s.sortedCommands() {
+			all = append(all, cmd.infoReply())
+		}
+		return c.WriteReply(all)
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "COUNT":
+		return c.WriteReply(Integer(len(s.commands)))
+
+	case "INFO":
+		names := args[1:]
+		if len(names) == 0 {
+			for _, cmd := range s.sortedCommands() {
+				names = append(names, cmd.Name)
+			}
+		}
+		infos := Array{}
+		for _, name := range names {
+			if cmd, ok := s.lookupCommand(name); ok {
+				infos = append(infos, cmd.infoReply())
+			} else {
+				infos = append(infos, NullBulk{})
+			}
+		}
+		return c.WriteReply(infos)
+
+	case "DOCS":
+		docs := Map{}
+		if len(args) == 1 {
+			for _, cmd := range s.sortedCommands() {
+				docs = append(docs, BulkString(cmd.Name), cmd.docsReply())
+			}
+		}
+		for _, name := range args[1:] {
+			if cmd, ok := s.lookupCommand(name); ok {
+				docs = append(docs, BulkString(cmd.Name), cmd.docsReply())
+			}
+		}
+		return c.WriteReply(docs)
+
+	case "LIST":
+		return s.commandList(c, args[1:])
+
+	case "GETKEYS":
+		if len(args) < 2 {
+			return c.WriteReply(ErrorReply("ERR Invalid arguments specified for command"))
+		}
+		argv := args[1:]
+		cmd, ok := s.lookupCommand(argv[0])
+		if !ok {
+			return c.WriteReply(ErrorReply("ERR Invalid command specified"))
+		}
+		if (cmd.Arity > 0 && len(argv) != cmd.Arity) || len(argv) < -cmd.Arity {
+			return c.WriteReply(ErrorReply("ERR Invalid number of arguments specified for command"))
+		}
+		positions := cmd.getKeys(argv)
+		if len(positions) == 0 {
+			return c.WriteReply(ErrorReply("ERR The command has no key arguments"))
+		}
+		keys := Array{}
+		for _, i := range positions {
+			keys = append(keys, BulkString(argv[i]))
+		}
+		return c.WriteReply(keys)
+	}
+
+	return c.WriteReply(ErrorReply("ERR unknown subcommand '" + args[0] + "'. Try COMMAND HELP."))
+}
+
+// COMMAND LIST [FILTERBY MODULE name | ACLCAT category | PATTERN pattern]
+func (s *RedisServer) commandList(c *Client, args []string) error {
+	match := func(cmd *Command) bool { return true }
+
+	if len(args) > 0 {
+		if len(args) != 3 || strings.ToUpper(args[0]) != "FILTERBY" {
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+		value := args[2]
+		switch strings.ToUpper(args[1]) {
+		case "MODULE":
+			// no modules are ever loaded
+			match = func(cmd *Command) bool { return false }
+		case "ACLCAT":
+			match = func(cmd *Command) bool {
+				for _, cat := range cmd.aclCategories() {
+					if strings.EqualFold(cat, "@"+value) {
+						return true
+					}
+				}
+				return false
+			}
+		case "PATTERN":
+			match = func(cmd *Command) bool {
+				return stringMatch(strings.ToLower(value), cmd.Name)
+			}
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	names := Array{}
+	for _, cmd := range s.sortedCommands() {
+		if match(cmd) {
+			names = append(names, BulkString(cmd.Name))
+		}
+	}
+	return c.WriteReply(names)
+}
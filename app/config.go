@@ -1,13 +1,21 @@
 package main
 
 import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
 	Role              string
-	Addr              string
+	Port              string
+	Bind              []string // addresses to listen on, a leading - marks one that may be missing
 	MasterAddr        string
 	MasterReplid      string
 	MasterReplOffset  int
@@ -15,16 +23,52 @@ type Config struct {
 	Connection        bool // if replica is connected to master
 	Dir               string
 	DBFilename        string
-	mu                sync.RWMutex
+	RequirePass       string // password of the default user, empty means no AUTH needed
+	MasterAuth        string // password a replica sends to its master
+	UnixSocket        string // path of a unix socket to listen on as well, empty for none
+	UnixSocketPerm    os.FileMode
+	// TLS is served on its own port next to the plain one
+	TLSPort        string
+	TLSCertFile    string
+	TLSKeyFile     string
+	TLSCACertFile  string
+	TLSAuthClients string // yes, no or optional
+	TLSReplication bool   // connect to our master over TLS
+	// limits on what a single client can make us buffer while reading
+	ProtoMaxBulkLen        int
+	MaxMultibulkLen        int
+	ClientQueryBufferLimit int
+	Timeout                int // seconds a normal client may stay idle, 0 disables it
+	TCPKeepAlive           int // seconds between keepalive probes, 0 disables them
+	MaxClients             int
+	ReplPingReplicaPeriod  int // seconds between the PINGs a master sends its replicas
+	ShutdownTimeout        int // seconds SHUTDOWN waits for lagging replicas
+	LCSMaxMemory           int // bytes the LCS table may take, 0 disables the check
+	// keyed by client class: normal, replica and pubsub
+	ClientOutputBufferLimit map[string]OutputBufferLimit
+	mu                      sync.RWMutex
 }
 
+// OutputBufferLimit closes a client whose pending replies go over Hard bytes,
+// or stay over Soft bytes for SoftSeconds in a row. Zero disables a limit.
+type OutputBufferLimit struct {
+	Hard        int
+	Soft        int
+	SoftSeconds int
+}
+
+// outputBufferClasses is the order CONFIG GET lists the classes in, replica
+// is still called slave there like in Redis
+var outputBufferClasses = []string{"normal", "replica", "pubsub"}
+
 type ServerState struct {
 }
 
 func parseArgs(args []string) *Config {
 	config := Config{
 		Role:              "master",
-		Addr:              "0.0.0.0:6379",
+		Port:              "6379",
+		Bind:              []string{"*", "-::*"},
 		MasterAddr:        "",
 		MasterReplid:      "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb", // master_replid
 		MasterReplOffset:  0,                                          // master_repl_offset
@@ -32,13 +76,38 @@ func parseArgs(args []string) *Config {
 		Connection:        false,
 		Dir:               "",
 		DBFilename:        "",
+		TLSPort:           "0",
+		TLSAuthClients:    "yes",
+
+		ProtoMaxBulkLen:        512 * 1024 * 1024,
+		MaxMultibulkLen:        math.MaxInt32,
+		ClientQueryBufferLimit: 1024 * 1024 * 1024,
+		TCPKeepAlive:           300,
+		MaxClients:             10000,
+		ReplPingReplicaPeriod:  10,
+		ShutdownTimeout:        10,
+		LCSMaxMemory:           512 * 1024 * 1024,
+		ClientOutputBufferLimit: map[string]OutputBufferLimit{
+			"normal":  {},
+			"replica": {Hard: 256 * 1024 * 1024, Soft: 64 * 1024 * 1024, SoftSeconds: 60},
+			"pubsub":  {Hard: 32 * 1024 * 1024, Soft: 8 * 1024 * 1024, SoftSeconds: 60},
+		},
 	}
 
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "--port":
 			i++
-			config.Addr = "0.0.0.0:" + args[i]
+			config.Port = args[i]
+
+		case "--bind":
+			// takes every value up to the next flag, each may itself hold
+			// several space separated addresses like in redis.conf
+			config.Bind = nil
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				config.Bind = append(config.Bind, strings.Fields(args[i])...)
+			}
 
 		case "--replicaof":
 			i++
@@ -52,8 +121,283 @@ func parseArgs(args []string) *Config {
 		case "--dir":
 			i++
 			config.Dir = args[i]
+
+		case "--requirepass":
+			i++
+			config.RequirePass = args[i]
+
+		case "--masterauth":
+			i++
+			config.MasterAuth = args[i]
+
+		case "--unixsocket":
+			i++
+			config.UnixSocket = args[i]
+
+		case "--unixsocketperm":
+			i++
+			perm, err := strconv.ParseUint(args[i], 8, 32)
+			if err != nil {
+				fmt.Printf("Invalid value for %s: %s\n", args[i-1], args[i])
+				os.Exit(1)
+			}
+			config.UnixSocketPerm = os.FileMode(perm)
+
+		case "--tls-port":
+			i++
+			config.TLSPort = args[i]
+
+		case "--tls-cert-file":
+			i++
+			config.TLSCertFile = args[i]
+
+		case "--tls-key-file":
+			i++
+			config.TLSKeyFile = args[i]
+
+		case "--tls-ca-cert-file":
+			i++
+			config.TLSCACertFile = args[i]
+
+		case "--tls-auth-clients":
+			i++
+			config.TLSAuthClients = strings.ToLower(args[i])
+
+		case "--tls-replication":
+			i++
+			config.TLSReplication = strings.ToLower(args[i]) == "yes"
+
+		case "--proto-max-bulk-len":
+			i++
+			config.ProtoMaxBulkLen = mustParseMemory(args[i-1], args[i])
+
+		case "--max-multibulk-len":
+			i++
+			config.MaxMultibulkLen = mustParseMemory(args[i-1], args[i])
+
+		case "--client-query-buffer-limit":
+			i++
+			config.ClientQueryBufferLimit = mustParseMemory(args[i-1], args[i])
+
+		case "--timeout":
+			i++
+			config.Timeout = mustParseInt(args[i-1], args[i])
+
+		case "--tcp-keepalive":
+			i++
+			config.TCPKeepAlive = mustParseInt(args[i-1], args[i])
+
+		case "--maxclients":
+			i++
+			// 0 would turn every connection away
+			config.MaxClients = mustParseIntAtLeast(args[i-1], args[i], 1)
+
+		case "--repl-ping-replica-period":
+			i++
+			config.ReplPingReplicaPeriod = mustParseInt(args[i-1], args[i])
+
+		case "--shutdown-timeout":
+			i++
+			config.ShutdownTimeout = mustParseInt(args[i-1], args[i])
+
+		case "--lcs-max-memory":
+			i++
+			config.LCSMaxMemory = mustParseMemory(args[i-1], args[i])
+
+		case "--client-output-buffer-limit":
+			// <class> <hard> <soft> <soft seconds>, repeated for every class
+			// to change, either as one value or spread over several
+			flag := args[i]
+			var fields []string
+			for i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				fields = append(fields, strings.Fields(args[i])...)
+			}
+			if len(fields) == 0 || len(fields)%4 != 0 {
+				fmt.Printf("Invalid value for %s: %s\n", flag, strings.Join(fields, " "))
+				os.Exit(1)
+			}
+			for j := 0; j < len(fields); j += 4 {
+				class := strings.ToLower(fields[j])
+				if class == "slave" {
+					class = "replica"
+				}
+				if _, ok := config.ClientOutputBufferLimit[class]; !ok {
+					fmt.Printf("Invalid client class for %s: %s\n", flag, fields[j])
+					os.Exit(1)
+				}
+				config.ClientOutputBufferLimit[class] = OutputBufferLimit{
+					Hard:        mustParseMemory(flag, fields[j+1]),
+					Soft:        mustParseMemory(flag, fields[j+2]),
+					SoftSeconds: mustParseInt(flag, fields[j+3]),
+				}
+			}
 		}
 	}
 
 	return &config
 }
+
+func mustParseMemory(flag string, value string) int {
+	n, err := parseMemory(value)
+	if err != nil {
+		fmt.Printf("Invalid value for %s: %s\n", flag, value)
+		os.Exit(1)
+	}
+	return int(n)
+}
+
+// configParams lists what CONFIG GET knows about, in the order it replies
+var configParams = []string{
+	"dir",
+	"dbfilename",
+	"requirepass",
+	"masterauth",
+	"port",
+	"bind",
+	"unixsocket",
+	"unixsocketperm",
+	"tls-port",
+	"tls-cert-file",
+	"tls-key-file",
+	"tls-ca-cert-file",
+	"tls-auth-clients",
+	"tls-replication",
+	"proto-max-bulk-len",
+	"max-multibulk-len",
+	"client-query-buffer-limit",
+	"timeout",
+	"tcp-keepalive",
+	"maxclients",
+	"client-output-buffer-limit",
+	"repl-ping-replica-period",
+	"shutdown-timeout",
+	"lcs-max-memory",
+}
+
+func mustParseInt(flag string, value string) int {
+	return mustParseIntAtLeast(flag, value, 0)
+}
+
+func mustParseIntAtLeast(flag string, value string, min int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min {
+		fmt.Printf("Invalid value for %s: %s\n", flag, value)
+		os.Exit(1)
+	}
+	return n
+}
+
+// Get returns a parameter the way CONFIG GET reports it
+func (c *Config) Get(param string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch param {
+	case "dir":
+		return c.Dir, true
+	case "dbfilename":
+		return c.DBFilename, true
+	case "requirepass":
+		return c.RequirePass, true
+	case "masterauth":
+		return c.MasterAuth, true
+	case "port":
+		return c.Port, true
+	case "bind":
+		return strings.Join(c.Bind, " "), true
+	case "unixsocket":
+		return c.UnixSocket, true
+	case "unixsocketperm":
+		return strconv.FormatUint(uint64(c.UnixSocketPerm), 8), true
+	case "tls-port":
+		return c.TLSPort, true
+	case "tls-cert-file":
+		return c.TLSCertFile, true
+	case "tls-key-file":
+		return c.TLSKeyFile, true
+	case "tls-ca-cert-file":
+		return c.TLSCACertFile, true
+	case "tls-auth-clients":
+		return c.TLSAuthClients, true
+	case "tls-replication":
+		return yesNo(c.TLSReplication), true
+	case "proto-max-bulk-len":
+		return strconv.Itoa(c.ProtoMaxBulkLen), true
+	case "max-multibulk-len":
+		return strconv.Itoa(c.MaxMultibulkLen), true
+	case "client-query-buffer-limit":
+		return strconv.Itoa(c.ClientQueryBufferLimit), true
+	case "timeout":
+		return strconv.Itoa(c.Timeout), true
+	case "tcp-keepalive":
+		return strconv.Itoa(c.TCPKeepAlive), true
+	case "maxclients":
+		return strconv.Itoa(c.MaxClients), true
+	case "shutdown-timeout":
+		return strconv.Itoa(c.ShutdownTimeout), true
+	case "repl-ping-replica-period":
+		return strconv.Itoa(c.ReplPingReplicaPeriod), true
+	case "lcs-max-memory":
+		return strconv.Itoa(c.LCSMaxMemory), true
+	case "client-output-buffer-limit":
+		var parts []string
+		for _, class := range outputBufferClasses {
+			limit := c.ClientOutputBufferLimit[class]
+			if class == "replica" {
+				class = "slave"
+			}
+			parts = append(parts, fmt.Sprintf("%s %d %d %d", class, limit.Hard, limit.Soft, limit.SoftSeconds))
+		}
+		return strings.Join(parts, " "), true
+	}
+	return "", false
+}
+
+// rdbPath is where snapshots are loaded from and saved to, empty when
+// persistence isn't configured
+func (c *Config) rdbPath() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.DBFilename == "" {
+		return ""
+	}
+	return filepath.Join(c.Dir, c.DBFilename)
+}
+
+func (c *Config) readLimits() readLimits {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return readLimits{
+		maxBulkLen:      c.ProtoMaxBulkLen,
+		maxMultibulkLen: c.MaxMultibulkLen,
+		maxQueryBuffer:  c.ClientQueryBufferLimit,
+	}
+}
+
+func (c *Config) outputBufferLimit(class string) OutputBufferLimit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ClientOutputBufferLimit[class]
+}
+
+// keepAliveConfig mirrors what Redis sets on its sockets: probes start after
+// tcp-keepalive seconds, are repeated every third of that, and 3 missed ones
+// drop the connection
+func (c *Config) keepAliveConfig() net.KeepAliveConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.TCPKeepAlive <= 0 {
+		return net.KeepAliveConfig{Enable: false}
+	}
+	period := time.Duration(c.TCPKeepAlive) * time.Second
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     period,
+		Interval: max(period/3, time.Second),
+		Count:    3,
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EXPIRE key seconds [NX | XX | GT | LT]
+func (h *RedisServer) handleEXPIRE(c *Client, args []string) error {
+	return h.expireGeneric(c, "expire", args, time.Now().UnixMilli(), 1000)
+}
+
+// PEXPIRE key milliseconds [NX | XX | GT | LT]
+func (h *RedisServer) handlePEXPIRE(c *Client, args []string) error {
+	return h.expireGeneric(c, "pexpire", args, time.Now().UnixMilli(), 1)
+}
+
+// EXPIREAT key unix-time-seconds [NX | XX | GT | LT]
+func (h *RedisServer) handleEXPIREAT(c *Client, args []string) error {
+	return h.expireGeneric(c, "expireat", args, 0, 1000)
+}
+
+// PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT]
+func (h *RedisServer) handlePEXPIREAT(c *Client, args []string) error {
+	return h.expireGeneric(c, "pexpireat", args, 0, 1)
+}
+
+// expireGeneric is the EXPIRE family, the time is multiplied by unit to get
+// millis and added to base, which is now for the relative ones and 0 for the
+// absolute ones. Replicas always get a PEXPIREAT so their clock doesn't
+// matter, or a DEL when the time has already passed.
+func (h *RedisServer) expireGeneric(c *Client, command string, args []string, base int64, unit int64) error {
+	key := args[0]
+	n, ok := parseInt64(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return c.WriteReply(ErrorReply(fmt.Sprintf("ERR Unsupported option %s", arg)))
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return c.WriteReply(ErrorReply("ERR NX and XX, GT or LT options at the same time are not compatible"))
+	}
+	if gt && lt {
+		return c.WriteReply(ErrorReply("ERR GT and LT options at the same time are not compatible"))
+	}
+
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return c.WriteReply(invalidExpireError(command))
+	}
+	when := n * unit
+	if when > math.MaxInt64-base {
+		return c.WriteReply(invalidExpireError(command))
+	}
+	when += base
+
+	// a replica keeps the key with a past expiry instead of deleting it, the
+	// master sends the DEL once the key expires there
+	fromMaster := c.hasFlag(ClientMaster)
+	op := h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		if !exists {
+			return "", 0, mutateNone
+		}
+		// no expiry counts as infinite for GT and LT
+		switch {
+		case nx && expiry != 0,
+			xx && expiry == 0,
+			gt && (expiry == 0 || when <= expiry),
+			lt && expiry != 0 && when >= expiry:
+			return "", 0, mutateNone
+		}
+		if when <= time.Now().UnixMilli() && !fromMaster {
+			return "", 0, mutateDelete
+		}
+		// 0 would mean no expiry at all
+		return value, max(when, 1), mutateSet
+	})
+
+	switch op {
+	case mutateNone:
+		return c.WriteReply(Integer(0))
+	case mutateDelete:
+		c.propagate = []string{"DEL", key}
+	default:
+		c.propagate = append([]string{"PEXPIREAT", key, strconv.FormatInt(when, 10)}, args[2:]...)
+	}
+	return c.WriteReply(Integer(1))
+}
+
+// TTL key
+func (h *RedisServer) handleTTL(c *Client, args []string) error {
+	return h.ttlGeneric(c, args[0], false, false)
+}
+
+// PTTL key
+func (h *RedisServer) handlePTTL(c *Client, args []string) error {
+	return h.ttlGeneric(c, args[0], true, false)
+}
+
+// EXPIRETIME key
+func (h *RedisServer) handleEXPIRETIME(c *Client, args []string) error {
+	return h.ttlGeneric(c, args[0], false, true)
+}
+
+// PEXPIRETIME key
+func (h *RedisServer) handlePEXPIRETIME(c *Client, args []string) error {
+	return h.ttlGeneric(c, args[0], true, true)
+}
+
+// ttlGeneric replies -2 for a missing key and -1 for one without an expiry,
+// otherwise the time left or, with absolute, the unix time it expires at
+func (h *RedisServer) ttlGeneric(c *Client, key string, millis bool, absolute bool) error {
+	expiry, ok := h.ram.Expiry(key)
+	switch {
+	case !ok:
+		return c.WriteReply(Integer(-2))
+	case expiry == 0:
+		return c.WriteReply(Integer(-1))
+	case absolute && millis:
+		return c.WriteReply(Integer(expiry))
+	case absolute:
+		return c.WriteReply(Integer(expiry / 1000))
+	}
+
+	ttl := max(expiry-time.Now().UnixMilli(), 0)
+	if millis {
+		return c.WriteReply(Integer(ttl))
+	}
+	return c.WriteReply(Integer((ttl + 500) / 1000))
+}
+
+// PERSIST key
+func (h *RedisServer) handlePERSIST(c *Client, args []string) error {
+	op := h.mutateKey(c, args[0], func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		if !exists || expiry == 0 {
+			return "", 0, mutateNone
+		}
+		return value, 0, mutateSet
+	})
+
+	if op == mutateNone {
+		return c.WriteReply(Integer(0))
+	}
+	return c.WriteReply(Integer(1))
+}
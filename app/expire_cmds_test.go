@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEXPIREOptions(t *testing.T) {
+	// absolute times keep the table independent of the clock
+	const at = 4102444800000
+	low, same, high := strconv.Itoa(at-1000), strconv.Itoa(at), strconv.Itoa(at+1000)
+
+	tests := []struct {
+		ttl     string // "none" for a key without expiry, "missing" for no key
+		options string
+		when    string
+		want    string
+		expiry  string // PEXPIRETIME afterwards
+	}{
+		{ttl: "none", when: high, want: ":1\r\n", expiry: high},
+		{ttl: "none", options: "NX", when: high, want: ":1\r\n", expiry: high},
+		{ttl: "none", options: "XX", when: high, want: ":0\r\n", expiry: "-1"},
+		// no expiry counts as infinite, nothing is greater
+		{ttl: "none", options: "GT", when: high, want: ":0\r\n", expiry: "-1"},
+		{ttl: "none", options: "LT", when: high, want: ":1\r\n", expiry: high},
+		{ttl: "none", options: "XX GT", when: high, want: ":0\r\n", expiry: "-1"},
+
+		{ttl: same, when: low, want: ":1\r\n", expiry: low},
+		{ttl: same, options: "NX", when: high, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "XX", when: high, want: ":1\r\n", expiry: high},
+		{ttl: same, options: "GT", when: high, want: ":1\r\n", expiry: high},
+		{ttl: same, options: "GT", when: same, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "GT", when: low, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "LT", when: low, want: ":1\r\n", expiry: low},
+		{ttl: same, options: "LT", when: same, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "LT", when: high, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "xx gt", when: high, want: ":1\r\n", expiry: high},
+		{ttl: same, options: "XX LT", when: high, want: ":0\r\n", expiry: same},
+		{ttl: same, options: "GT GT", when: high, want: ":1\r\n", expiry: high},
+
+		{ttl: "missing", when: high, want: ":0\r\n", expiry: "-2"},
+		{ttl: "missing", options: "NX", when: high, want: ":0\r\n", expiry: "-2"},
+		{ttl: "missing", options: "LT", when: high, want: ":0\r\n", expiry: "-2"},
+
+		// a time in the past deletes the key, unless the option stops it
+		{ttl: "none", when: "1", want: ":1\r\n", expiry: "-2"},
+		{ttl: same, options: "LT", when: "1", want: ":1\r\n", expiry: "-2"},
+		{ttl: same, options: "GT", when: "1", want: ":0\r\n", expiry: same},
+		{ttl: "none", options: "GT", when: "1", want: ":0\r\n", expiry: "-1"},
+
+		{ttl: "none", options: "NX XX", when: high, want: "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n", expiry: "-1"},
+		{ttl: "none", options: "NX GT", when: high, want: "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n", expiry: "-1"},
+		{ttl: "none", options: "NX LT", when: high, want: "-ERR NX and XX, GT or LT options at the same time are not compatible\r\n", expiry: "-1"},
+		{ttl: "none", options: "GT LT", when: high, want: "-ERR GT and LT options at the same time are not compatible\r\n", expiry: "-1"},
+		{ttl: "none", options: "FOO", when: high, want: "-ERR Unsupported option FOO\r\n", expiry: "-1"},
+		{ttl: "none", when: "soon", want: "-ERR value is not an integer or out of range\r\n", expiry: "-1"},
+	}
+
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	for _, tt := range tests {
+		run(s, c, "DEL", "k")
+		switch tt.ttl {
+		case "none":
+			run(s, c, "SET", "k", "v")
+		case "missing":
+		default:
+			run(s, c, "SET", "k", "v", "PXAT", tt.ttl)
+		}
+
+		args := append([]string{"PEXPIREAT", "k", tt.when}, strings.Fields(tt.options)...)
+		if got := run(s, c, args...); got != tt.want {
+			t.Errorf("%v with ttl %s = %q, want %q", args, tt.ttl, got, tt.want)
+		}
+		if got, want := run(s, c, "PEXPIRETIME", "k"), ":"+tt.expiry+"\r\n"; got != want {
+			t.Errorf("%v with ttl %s left PEXPIRETIME %q, want %q", args, tt.ttl, got, want)
+		}
+	}
+}
+
+func TestEXPIREReplicatedForm(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string // nil when nothing is propagated
+	}{
+		{args: []string{"EXPIREAT", "k", "4102444800"}, want: []string{"PEXPIREAT", "k", "4102444800000"}},
+		{args: []string{"PEXPIREAT", "k", "4102444800001", "GT"}, want: []string{"PEXPIREAT", "k", "4102444800001", "GT"}},
+		{args: []string{"PEXPIREAT", "k", "4102444800000", "GT"}, want: nil},
+		{args: []string{"EXPIRE", "k", "-1"}, want: []string{"DEL", "k"}},
+		{args: []string{"EXPIRE", "k", "10"}, want: nil},
+	}
+
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	run(s, c, "SET", "k", "v")
+
+	for _, tt := range tests {
+		dirty := c.dirty
+		run(s, c, tt.args...)
+		got := c.propagate
+		if c.dirty == dirty {
+			got = nil
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v propagated %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
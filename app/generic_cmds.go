@@ -0,0 +1,118 @@
+package main
+
+import "strings"
+
+// DEL key [key ...]
+func (h *RedisServer) handleDEL(c *Client, args []string) error {
+	deleted := 0
+	for _, key := range args {
+		if h.deleteKey(c, key) {
+			deleted++
+		}
+	}
+	return c.WriteReply(Integer(deleted))
+}
+
+// UNLINK key [key ...], values are plain strings here so there is nothing to
+// free in the background and it is the same as DEL
+func (h *RedisServer) handleUNLINK(c *Client, args []string) error {
+	return h.handleDEL(c, args)
+}
+
+// EXISTS key [key ...], a key given twice is counted twice
+func (h *RedisServer) handleEXISTS(c *Client, args []string) error {
+	count := 0
+	for _, key := range args {
+		if h.keyExists(key) {
+			count++
+		}
+	}
+	return c.WriteReply(Integer(count))
+}
+
+// TOUCH key [key ...]
+func (h *RedisServer) handleTOUCH(c *Client, args []string) error {
+	count := 0
+	for _, key := range args {
+		if h.touchKey(key) {
+			count++
+		}
+	}
+	return c.WriteReply(Integer(count))
+}
+
+// TYPE key
+func (h *RedisServer) handleTYPE(c *Client, args []string) error {
+	if !h.keyExists(args[0]) {
+		return c.WriteReply(SimpleString("none"))
+	}
+	return c.WriteReply(SimpleString("string"))
+}
+
+// RENAME key newkey
+func (h *RedisServer) handleRENAME(c *Client, args []string) error {
+	found, _ := h.renameKey(c, args[0], args[1], false)
+	if !found {
+		return c.WriteReply(ErrorReply("ERR no such key"))
+	}
+	return c.WriteReply(OK)
+}
+
+// RENAMENX key newkey
+func (h *RedisServer) handleRENAMENX(c *Client, args []string) error {
+	found, renamed := h.renameKey(c, args[0], args[1], true)
+	switch {
+	case !found:
+		return c.WriteReply(ErrorReply("ERR no such key"))
+	case !renamed:
+		return c.WriteReply(Integer(0))
+	}
+	return c.WriteReply(Integer(1))
+}
+
+// COPY source destination [DB destination-db] [REPLACE], there is only
+// database 0 to copy to
+func (h *RedisServer) handleCOPY(c *Client, args []string) error {
+	src, dst := args[0], args[1]
+	replace := false
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "REPLACE":
+			replace = true
+		case opt == "DB" && i+1 < len(args):
+			i++
+			db, ok := parseInt64(args[i])
+			if !ok {
+				return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+			}
+			if db != 0 {
+				return c.WriteReply(ErrorReply("ERR DB index is out of range"))
+			}
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+
+	if src == dst {
+		return c.WriteReply(ErrorReply("ERR source and destination objects are the same"))
+	}
+	if !h.copyKey(c, src, dst, replace) {
+		return c.WriteReply(Integer(0))
+	}
+	return c.WriteReply(Integer(1))
+}
+
+// RANDOMKEY
+func (h *RedisServer) handleRANDOMKEY(c *Client, args []string) error {
+	key, ok := h.ram.RandomKey()
+	if !ok {
+		return c.WriteReply(NullBulk{})
+	}
+	return c.WriteReply(BulkString(key))
+}
+
+// DBSIZE
+func (h *RedisServer) handleDBSIZE(c *Client, args []string) error {
+	return c.WriteReply(Integer(h.ram.Len()))
+}
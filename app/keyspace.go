@@ -0,0 +1,99 @@
+package main
+
+// setKey, deleteKey and the other writers below are the paths every write to
+// the keyspace goes through, commands shouldn't call ram directly so nothing
+// that changes a key can forget to signal it.
+
+func (s *RedisServer) setKey(c *Client, key string, value string, expiry int64) {
+	s.ram.Set(key, value, expiry)
+	s.signalModifiedKey(c, key)
+}
+
+// deleteKey reports whether key existed, only then is it signaled
+func (s *RedisServer) deleteKey(c *Client, key string) bool {
+	if !s.ram.Delete(key) {
+		return false
+	}
+	s.signalModifiedKey(c, key)
+	return true
+}
+
+// renameKey is RENAME and RENAMENX, see SafeMap.Rename
+func (s *RedisServer) renameKey(c *Client, src, dst string, nx bool) (found bool, renamed bool) {
+	found, renamed = s.ram.Rename(src, dst, nx)
+	if renamed {
+		s.signalModifiedKey(c, src)
+		s.signalModifiedKey(c, dst)
+	}
+	return found, renamed
+}
+
+// copyKey is COPY, see SafeMap.Copy
+func (s *RedisServer) copyKey(c *Client, src, dst string, replace bool) bool {
+	if !s.ram.Copy(src, dst, replace) {
+		return false
+	}
+	s.signalModifiedKey(c, dst)
+	return true
+}
+
+// setKeys is the MSET path, see SafeMap.SetMany
+func (s *RedisServer) setKeys(c *Client, pairs []string, nx bool) bool {
+	if !s.ram.SetMany(pairs, nx) {
+		return false
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		s.signalModifiedKey(c, pairs[i])
+	}
+	return true
+}
+
+// mutateKey is the read-modify-write path, see SafeMap.Mutate
+func (s *RedisServer) mutateKey(c *Client, key string, fn func(value string, expiry int64, exists bool) (string, int64, mutation)) mutation {
+	op := s.ram.Mutate(key, fn)
+	if op != mutateNone {
+		s.signalModifiedKey(c, key)
+	}
+	return op
+}
+
+// lookupKey is the read path, a CLIENT NO-TOUCH connection reads without
+// updating the access time
+func (s *RedisServer) lookupKey(c *Client, key string) (string, bool) {
+	if c != nil && c.hasFlag(ClientNoTouch) {
+		return s.ram.Peek(key)
+	}
+	return s.ram.Get(key)
+}
+
+// touchKey counts as an access even for a CLIENT NO-TOUCH connection, that is
+// what TOUCH is for
+func (s *RedisServer) touchKey(key string) bool {
+	_, ok := s.ram.Get(key)
+	return ok
+}
+
+// keyExists checks for key without counting as an access
+func (s *RedisServer) keyExists(key string) bool {
+	_, ok := s.ram.Peek(key)
+	return ok
+}
+
+// expiredKey is called when a read finds key past its expiry and drops it.
+// The replicas are sent a DEL so they lose the key at the same point of the
+// replication stream instead of going by their own clock.
+func (s *RedisServer) expiredKey(key string) {
+	s.signalModifiedKey(nil, key)
+	if s.config.Role == "master" {
+		s.propagateWrite(s.replica, []string{"DEL", key})
+	}
+}
+
+// signalModifiedKey is called after key changed, c is the client that changed
+// it or nil when it expired
+func (s *RedisServer) signalModifiedKey(c *Client, key string) {
+	if c != nil {
+		c.dirty++
+	}
+	s.trackingInvalidateKey(c, key)
+}
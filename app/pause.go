@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// pausePurpose says who paused, each one only ends its own pause so SHUTDOWN
+// giving up doesn't lift a CLIENT PAUSE and CLIENT UNPAUSE doesn't let writes
+// through while a shutdown waits for its replicas
+type pausePurpose int
+
+const (
+	pauseByClient pausePurpose = iota
+	pauseDuringShutdown
+	numPausePurposes
+)
+
+type pause struct {
+	end time.Time
+	all bool // ALL pauses every command, WRITE only the ones that change data
+}
+
+// pauseState is what CLIENT PAUSE and SHUTDOWN set. Paused clients wait inside
+// ExecuteCmd until every pause ends, either on its own or through Unpause,
+// which closes resumed to wake them all.
+type pauseState struct {
+	mu      sync.Mutex
+	pauses  [numPausePurposes]pause
+	resumed chan struct{}
+}
+
+func newPauseState() *pauseState {
+	return &pauseState{resumed: make(chan struct{})}
+}
+
+// Pause starts or extends a pause. Like Redis a second pause never shortens
+// the current one or relaxes it from ALL to WRITE.
+func (p *pauseState) Pause(purpose pausePurpose, until time.Time, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cur := &p.pauses[purpose]
+	if time.Now().After(cur.end) {
+		cur.all = false
+	}
+	if until.After(cur.end) {
+		cur.end = until
+	}
+	cur.all = cur.all || all
+}
+
+// Unpause ends the pause of purpose, the others stay in effect
+func (p *pauseState) Unpause(purpose pausePurpose) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pauses[purpose] = pause{}
+	close(p.resumed)
+	p.resumed = make(chan struct{})
+}
+
+// Active reports whether any pause is in effect, the replication cron and
+// key expiry check it to keep the replication offset still
+func (p *pauseState) Active() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, cur := range p.pauses {
+		if now.Before(cur.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks reports whether a command has to wait, and until when at most
+func (p *pauseState) blocks(write bool) (bool, time.Time, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var end time.Time
+	for _, cur := range p.pauses {
+		if now.Before(cur.end) && (cur.all || write) && cur.end.After(end) {
+			end = cur.end
+		}
+	}
+	if end.IsZero() {
+		return false, time.Time{}, nil
+	}
+	return true, end, p.resumed
+}
+
+// waitForUnpause holds a client that sent a paused command until the pause is
+// over. It counts as blocked meanwhile, so the idle timeout leaves it alone.
+// Replicas and our master are never paused, and neither is CLIENT UNPAUSE or
+// there would be no way out of an ALL pause.
+func (s *RedisServer) waitForUnpause(c *Client, command *Command, name string) {
+	if c.hasFlag(ClientMaster|ClientReplica) || name == "client|unpause" {
+		return
+	}
+
+	held := false
+	for {
+		paused, end, resumed := s.pause.blocks(command.IsWrite())
+		if !paused {
+			break
+		}
+		if !held {
+			held = true
+			c.setFlag(ClientBlocked, true)
+			// replies to the commands before this one shouldn't wait too
+			c.Flush()
+		}
+
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-resumed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+
+	if held {
+		c.setFlag(ClientBlocked, false)
+	}
+}
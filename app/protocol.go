@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type ProtocolHandler struct{}
@@ -13,108 +16,379 @@ func NewProtocolHandler() *ProtocolHandler {
 	return &ProtocolHandler{}
 }
 
-func (p *ProtocolHandler) readCommands(conn net.Conn) ([]string, error) {
-	//Constraint, command can't be longer than 1024
-	buffer := make([]byte, 4092)
-	n, err := conn.Read(buffer)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read command: %w", err)
-	}
+// readChunk is the minimum amount of free space kept at the end of a
+// RESPReader buffer before every read from the connection.
+const readChunk = 16 * 1024
 
-	command, err, _ := p.parseArray(buffer[:n])
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse command: %w", err)
-	}
+// maxInlineLen is how long an inline command line may get before the client
+// is considered to be sending garbage, same limit Redis uses.
+const maxInlineLen = 64 * 1024
+
+// errIncomplete means the buffer ends in the middle of a frame and more data
+// has to be read before it can be decoded.
+var errIncomplete = errors.New("incomplete frame")
+
+// errQueryBufferLimit means the client sent more undecoded data than
+// client-query-buffer-limit allows, it is dropped without a reply like Redis does.
+var errQueryBufferLimit = errors.New("client reached max query buffer length")
 
-	return command, nil
+// ProtocolError is a malformed request. The client is told what was wrong and
+// then disconnected, there is no way to find where the next command starts.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readLimits caps how much a single client can make the server buffer, zero
+// means no limit. The link to our master is trusted and gets none.
+type readLimits struct {
+	maxBulkLen      int
+	maxMultibulkLen int
+	maxQueryBuffer  int
 }
 
-func (p *ProtocolHandler) parseArrays(data []byte) ([][]string, []int, error) {
-	var arrays [][]string
-	var array_len []int
-	var pos int = 0
+// RESPReader is the per connection decoder. It keeps whatever was read but not
+// yet decoded so frames split across TCP segments, or bulk strings far larger
+// than a single read, are put back together on the next read.
+type RESPReader struct {
+	protocol *ProtocolHandler
+	rd       io.Reader
+	buf      []byte
+	pos      int   // start of the data that hasn't been decoded yet
+	err      error // parse error to report once the commands before it ran
+	limits   readLimits
+	lastRead atomic.Int64 // unix nanos of the last successful read, for idle checks
+}
 
-	for pos < len(data) {
-		idx := bytes.IndexByte(data[pos:], '*')
-		if idx == -1 {
-			break // No more arrays
+func (p *ProtocolHandler) NewReader(rd io.Reader) *RESPReader {
+	return &RESPReader{
+		protocol: p,
+		rd:       rd,
+		buf:      make([]byte, 0, readChunk),
+	}
+}
+
+// ReadCommands blocks until at least one full command is buffered and then
+// returns every complete command, together with how many bytes each one took
+// on the wire. A trailing partial command stays buffered for the next call.
+func (r *RESPReader) ReadCommands() ([][]string, []int, error) {
+	for {
+		if r.err != nil {
+			return nil, nil, fmt.Errorf("failed to parse command: %w", r.err)
 		}
 
-		// parse from this position
-		array, err, consumed := p.parseArray(data[pos+idx:])
-		if err != nil {
+		cmds, lengths := r.decodeBuffered()
+		if len(cmds) > 0 {
+			return cmds, lengths, nil
+		}
+		if r.err != nil {
+			continue
+		}
+
+		if err := r.fill(); err != nil {
 			return nil, nil, err
 		}
+	}
+}
 
-		arrays = append(arrays, array)
+// decodeBuffered returns the complete commands at the front of the buffer. A
+// malformed frame stops decoding and is kept in r.err, so the commands that
+// came before it still run, the same order of events as in Redis.
+func (r *RESPReader) decodeBuffered() ([][]string, []int) {
+	var cmds [][]string
+	var lengths []int
 
-		array_len = append(array_len, consumed)
-		fmt.Printf("amount consumed %d", consumed)
+	for r.pos < len(r.buf) {
+		var cmd []string
+		var err error
+		var consumed int
 
-		pos += idx + consumed
+		if r.buf[r.pos] == '*' {
+			cmd, err, consumed = r.protocol.parseArray(r.buf[r.pos:], r.limits)
+		} else {
+			cmd, err, consumed = r.protocol.parseInline(r.buf[r.pos:])
+		}
+		if err == errIncomplete {
+			break
+		}
+		if err != nil {
+			r.err = err
+			break
+		}
+
+		r.pos += consumed
+		// blank lines are how telnet users keep a session alive, skip them
+		if len(cmd) == 0 {
+			continue
+		}
+
+		cmds = append(cmds, cmd)
+		lengths = append(lengths, consumed)
+	}
+
+	return cmds, lengths
+}
+
+// Buffered is the number of bytes read from the connection but not decoded yet
+func (r *RESPReader) Buffered() int {
+	return len(r.buf) - r.pos
+}
+
+// fill reads more data from the connection, first moving the undecoded part
+// to the front of the buffer and growing it if there isn't enough room left.
+func (r *RESPReader) fill() error {
+	if r.pos > 0 {
+		n := copy(r.buf, r.buf[r.pos:])
+		r.buf = r.buf[:n]
+		r.pos = 0
+	}
+
+	if cap(r.buf)-len(r.buf) < readChunk {
+		grown := make([]byte, len(r.buf), 2*cap(r.buf)+readChunk)
+		copy(grown, r.buf)
+		r.buf = grown
 	}
 
-	return arrays, array_len, nil
+	n, err := r.rd.Read(r.buf[len(r.buf):cap(r.buf)])
+	r.buf = r.buf[:len(r.buf)+n]
+	if n > 0 {
+		r.lastRead.Store(time.Now().UnixNano())
+	}
+	if r.limits.maxQueryBuffer > 0 && r.Buffered() > r.limits.maxQueryBuffer {
+		return errQueryBufferLimit
+	}
+	if n > 0 {
+		return nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return fmt.Errorf("failed to read command: %w", err)
+	}
+	return nil
 }
 
 // redis protocol parser
-func (p *ProtocolHandler) parseArray(data []byte) ([]string, error, int) {
-	if len(data) == 0 || data[0] != '*' {
-		return nil, fmt.Errorf("expected array, got %x", data[0]), 0
+func (p *ProtocolHandler) parseArray(data []byte, limits readLimits) ([]string, error, int) {
+	if len(data) == 0 {
+		return nil, errIncomplete, 0
+	}
+	if data[0] != '*' {
+		return nil, ProtocolError(fmt.Sprintf("expected '*', got '%c'", data[0])), 0
 	}
 	idx := bytes.IndexByte(data, '\n')
-	if idx <= 0 || data[idx-1] != '\r' {
-		return nil, fmt.Errorf("malformed array length"), 0
+	if idx == -1 {
+		if len(data) > maxInlineLen {
+			return nil, ProtocolError("too big mbulk count string"), 0
+		}
+		return nil, errIncomplete, 0
+	}
+	if idx == 0 || data[idx-1] != '\r' {
+		return nil, ProtocolError("invalid multibulk length"), 0
 	}
 	length, err := strconv.Atoi(string(data[1 : idx-1]))
-	if err != nil {
-		return nil, fmt.Errorf("invalid array length: %s", string(data[1:idx-1])), 0
+	if err != nil || (limits.maxMultibulkLen > 0 && length > limits.maxMultibulkLen) {
+		return nil, ProtocolError("invalid multibulk length"), 0
 	}
 	pos := idx + 1
-	result := make([]string, length)
+	// the header alone can't be trusted to size the slice, a bogus count
+	// would allocate before a single element arrived
+	result := make([]string, 0, min(max(length, 0), 1024))
 
 	for i := 0; i < length; i++ {
-		element, bytesRead, err := p.parseBulkString(data[pos:])
+		element, bytesRead, err := p.parseBulkString(data[pos:], limits)
 		if err != nil {
 			return nil, err, 0
 		}
-		result[i] = element
+		result = append(result, element)
 		pos += bytesRead
 	}
 
 	return result, nil, pos
 }
 
-func (p *ProtocolHandler) parseBulkString(data []byte) (string, int, error) {
-	if len(data) == 0 || data[0] != '$' {
-		return "", 0, fmt.Errorf("expected bulk string modifier, got %c", data[0])
+// parseInline handles the plain text form used by nc and telnet, a single
+// line of space separated arguments, e.g. SET foo "bar baz"
+func (p *ProtocolHandler) parseInline(data []byte) ([]string, error, int) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx == -1 {
+		if len(data) > maxInlineLen {
+			return nil, ProtocolError("too big inline request"), 0
+		}
+		return nil, errIncomplete, 0
+	}
+	if idx > maxInlineLen {
+		return nil, ProtocolError("too big inline request"), 0
+	}
+
+	line := data[:idx]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	args, err := splitInlineArgs(string(line))
+	if err != nil {
+		return nil, ProtocolError(err.Error()), 0
+	}
+
+	return args, nil, idx + 1
+}
+
+// splitInlineArgs follows the quoting rules of sdssplitargs in Redis: double
+// quotes understand \xHH and the usual C escapes, single quotes only \', and
+// a closing quote has to be followed by a space or the end of the line.
+func splitInlineArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var current []byte
+		inDouble, inSingle, done := false, false, false
+
+		for !done {
+			if inDouble {
+				if i == len(line) {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					current = append(current, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				} else if c == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			} else if inSingle {
+				if i == len(line) {
+					return nil, fmt.Errorf("unbalanced quotes in request")
+				}
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isInlineSpace(line[i+1]) {
+						return nil, fmt.Errorf("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			} else {
+				if i == len(line) {
+					break
+				}
+				switch c := line[i]; {
+				case isInlineSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					current = append(current, c)
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+
+		args = append(args, string(current))
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func (p *ProtocolHandler) parseBulkString(data []byte, limits readLimits) (string, int, error) {
+	if len(data) == 0 {
+		return "", 0, errIncomplete
+	}
+	if data[0] != '$' {
+		return "", 0, ProtocolError(fmt.Sprintf("expected '$', got '%c'", data[0]))
 	}
 	idx := bytes.IndexByte(data, '\n')
-	if idx <= 0 || data[idx-1] != '\r' {
-		return "", 0, fmt.Errorf("malformed bulk string length")
+	if idx == -1 {
+		if len(data) > maxInlineLen {
+			return "", 0, ProtocolError("too big bulk count string")
+		}
+		return "", 0, errIncomplete
+	}
+	if idx == 0 || data[idx-1] != '\r' {
+		return "", 0, ProtocolError("invalid bulk length")
 	}
 
 	length, err := strconv.Atoi(string(data[1 : idx-1]))
-	if err != nil {
-		return "", 0, fmt.Errorf("invalid bulk string length: %s", string(data[1:idx-1]))
+	if err != nil || length < 0 || (limits.maxBulkLen > 0 && length > limits.maxBulkLen) {
+		return "", 0, ProtocolError("invalid bulk length")
 	}
 
 	endPos := idx + 1 + length + 2 // +1 for \n after length, +2 for \r\n after data
 	if len(data) < endPos {
-		return "", 0, fmt.Errorf("incomplete bulk string data")
+		return "", 0, errIncomplete
 	}
 
 	result := string(data[idx+1 : idx+1+length])
 
 	if data[idx+1+length] != '\r' || data[idx+1+length+1] != '\n' {
-		return "", 0, fmt.Errorf("malformed bulk string terminator")
+		return "", 0, ProtocolError("malformed bulk string terminator")
 	}
 
 	return result, endPos, nil
 }
 
 func (p *ProtocolHandler) parseSimpleString(data []byte) (string, int, error) {
-	if len(data) == 0 || data[0] != '+' {
+	if len(data) == 0 {
+		return "", 0, fmt.Errorf("expected simple string, got nothing")
+	}
+	if data[0] != '+' {
 		return "", 0, fmt.Errorf("expected simple string, got %c", data[0])
 	}
 
@@ -127,24 +401,10 @@ func (p *ProtocolHandler) parseSimpleString(data []byte) (string, int, error) {
 	return result, idx + 1, nil
 }
 
-func (p *ProtocolHandler) intToIntString(value int) string {
-	return ":" + strconv.Itoa(value) + "\r\n"
-}
-
-func (p *ProtocolHandler) stringToBulkString(value string) string {
-	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
-}
-
-func (p *ProtocolHandler) stringToSimpleString(value string) string {
-	return "+" + value + "\r\n"
-}
-
-func (p *ProtocolHandler) stringToArray(value []string) string {
-	result := "*" + strconv.Itoa(len(value)) + "\r\n"
-
-	for i := 0; i < len(value); i++ {
-		result += p.stringToBulkString(value[i])
-	}
-
-	return result
+// encodeCommand serializes a command the way clients send it, used for the
+// replication handshake and to forward writes to replicas.
+func (p *ProtocolHandler) encodeCommand(args []string) []byte {
+	var buf bytes.Buffer
+	p.writeReply(&buf, 2, BulkStrings(args))
+	return buf.Bytes()
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// chunkReader hands out one chunk per Read, the way frames arrive split over
+// several TCP segments
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if n < len(r.chunks[0]) {
+		r.chunks[0] = r.chunks[0][n:]
+	} else {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestReadCommands(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunks  []string
+		limits  readLimits
+		want    [][]string
+		wantErr string // empty means the reader runs into EOF
+	}{
+		{
+			name:   "frame split across reads",
+			chunks: []string{"*2\r\n$3\r\nGE", "T\r\n$1", "\r\nk\r", "\n"},
+			want:   [][]string{{"GET", "k"}},
+		},
+		{
+			name:   "header split across reads",
+			chunks: []string{"*", "1\r", "\n$4\r\nPING\r\n"},
+			want:   [][]string{{"PING"}},
+		},
+		{
+			name:   "pipelined frames",
+			chunks: []string{"*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"},
+			want:   [][]string{{"PING"}, {"ECHO", "hi"}},
+		},
+		{
+			name:   "pipelined frames split across reads",
+			chunks: []string{"*1\r\n$4\r\nPING\r\n*2\r\n$4\r\nEC", "HO\r\n$2\r\nhi\r\n"},
+			want:   [][]string{{"PING"}, {"ECHO", "hi"}},
+		},
+		{
+			name:   "pipelined inline commands",
+			chunks: []string{"PING\r\nECHO hi\n"},
+			want:   [][]string{{"PING"}, {"ECHO", "hi"}},
+		},
+		{
+			name:   "null multibulk is skipped",
+			chunks: []string{"*-1\r\n*1\r\n$4\r\nPING\r\n"},
+			want:   [][]string{{"PING"}},
+		},
+		{
+			name:   "empty multibulk is skipped",
+			chunks: []string{"*0\r\n*1\r\n$4\r\nPING\r\n"},
+			want:   [][]string{{"PING"}},
+		},
+		{
+			name:   "blank inline line is skipped",
+			chunks: []string{"\r\n\nPING\r\n"},
+			want:   [][]string{{"PING"}},
+		},
+		{
+			name:   "binary safe bulk string",
+			chunks: []string{"*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n"},
+			want:   [][]string{{"ECHO", "a\r\nb"}},
+		},
+		{
+			name:    "commands before a malformed frame still run",
+			chunks:  []string{"PING\r\n*1\r\nx\r\n"},
+			want:    [][]string{{"PING"}},
+			wantErr: "Protocol error: expected '$', got 'x'",
+		},
+		{
+			name:    "unbalanced quotes",
+			chunks:  []string{"SET k \"v\r\n"},
+			wantErr: "Protocol error: unbalanced quotes in request",
+		},
+		{
+			name:    "negative bulk length",
+			chunks:  []string{"*1\r\n$-1\r\n"},
+			wantErr: "Protocol error: invalid bulk length",
+		},
+		{
+			name:    "bulk terminator missing",
+			chunks:  []string{"*1\r\n$4\r\nPINGxx"},
+			wantErr: "Protocol error: malformed bulk string terminator",
+		},
+		{
+			name:    "bulk longer than proto-max-bulk-len",
+			chunks:  []string{"*1\r\n$5\r\nhello\r\n"},
+			limits:  readLimits{maxBulkLen: 4},
+			wantErr: "Protocol error: invalid bulk length",
+		},
+		{
+			name:   "bulk at proto-max-bulk-len",
+			chunks: []string{"*1\r\n$4\r\nPING\r\n"},
+			limits: readLimits{maxBulkLen: 4},
+			want:   [][]string{{"PING"}},
+		},
+		{
+			name:    "multibulk longer than max-multibulk-len",
+			chunks:  []string{"*3\r\n"},
+			limits:  readLimits{maxMultibulkLen: 2},
+			wantErr: "Protocol error: invalid multibulk length",
+		},
+		{
+			name:    "query buffer over client-query-buffer-limit",
+			chunks:  []string{"*1\r\n$100\r\n" + strings.Repeat("x", 20)},
+			limits:  readLimits{maxQueryBuffer: 16},
+			wantErr: errQueryBufferLimit.Error(),
+		},
+		{
+			name:    "inline request without a newline",
+			chunks:  []string{strings.Repeat("a", maxInlineLen+1)},
+			wantErr: "Protocol error: too big inline request",
+		},
+		{
+			name:    "multibulk count without a newline",
+			chunks:  []string{"*" + strings.Repeat("1", maxInlineLen+1)},
+			wantErr: "Protocol error: too big mbulk count string",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewProtocolHandler().NewReader(&chunkReader{chunks: tt.chunks})
+			r.limits = tt.limits
+
+			var got [][]string
+			var err error
+			for {
+				var cmds [][]string
+				cmds, _, err = r.ReadCommands()
+				if err != nil {
+					break
+				}
+				got = append(got, cmds...)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr == "" {
+				if err != io.EOF {
+					t.Errorf("err = %v, want EOF", err)
+				}
+			} else if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadCommandsLengths(t *testing.T) {
+	frames := []string{"*1\r\n$4\r\nPING\r\n", "ECHO hi\r\n", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"}
+	r := NewProtocolHandler().NewReader(&chunkReader{chunks: []string{strings.Join(frames, "")}})
+
+	_, lengths, err := r.ReadCommands()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{len(frames[0]), len(frames[1]), len(frames[2])}
+	if !reflect.DeepEqual(lengths, want) {
+		t.Errorf("lengths = %v, want %v", lengths, want)
+	}
+}
+
+func TestSplitInlineArgs(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{line: "", want: nil},
+		{line: "   ", want: nil},
+		{line: "SET k v", want: []string{"SET", "k", "v"}},
+		{line: "  SET \t k   v  ", want: []string{"SET", "k", "v"}},
+		{line: `SET k "hello world"`, want: []string{"SET", "k", "hello world"}},
+		{line: `SET k ""`, want: []string{"SET", "k", ""}},
+		{line: `SET k "\x41\x4a\x7e"`, want: []string{"SET", "k", "AJ~"}},
+		{line: `SET k "\x00"`, want: []string{"SET", "k", "\x00"}},
+		{line: `SET k "\xZZ"`, want: []string{"SET", "k", "xZZ"}},
+		{line: `SET k "\x4"`, want: []string{"SET", "k", "x4"}},
+		{line: `SET k "a\nb\tc\rd\\e\"f"`, want: []string{"SET", "k", "a\nb\tc\rd\\e\"f"}},
+		{line: `SET k 'it\'s'`, want: []string{"SET", "k", "it's"}},
+		{line: `SET k 'a\nb'`, want: []string{"SET", "k", `a\nb`}},
+		{line: `SET k 'a "b" c'`, want: []string{"SET", "k", `a "b" c`}},
+		{line: `SET k "unterminated`, wantErr: true},
+		{line: `SET k 'unterminated`, wantErr: true},
+		{line: `SET k "closed"x`, wantErr: true},
+		{line: `SET k 'closed'x`, wantErr: true},
+		{line: `SET k "ends in a backslash\`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := splitInlineArgs(tt.line)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitInlineArgs(%q) = %q, want an error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitInlineArgs(%q) failed: %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitInlineArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseSimpleString(t *testing.T) {
+	tests := []struct {
+		data     string
+		want     string
+		consumed int
+		wantErr  bool
+	}{
+		{data: "+OK\r\n", want: "OK", consumed: 5},
+		{data: "+FULLRESYNC abc 0\r\n$3\r\n", want: "FULLRESYNC abc 0", consumed: 19},
+		{data: "+\r\n", want: "", consumed: 3},
+		{data: "", wantErr: true},
+		{data: "-ERR nope\r\n", wantErr: true},
+		{data: "+OK", wantErr: true},
+		{data: "+OK\n", wantErr: true},
+	}
+
+	p := NewProtocolHandler()
+	for _, tt := range tests {
+		got, consumed, err := p.parseSimpleString([]byte(tt.data))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSimpleString(%q) = %q, want an error", tt.data, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want || consumed != tt.consumed {
+			t.Errorf("parseSimpleString(%q) = %q, %d, %v, want %q, %d", tt.data, got, consumed, err, tt.want, tt.consumed)
+		}
+	}
+}
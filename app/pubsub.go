@@ -0,0 +1,142 @@
+package main
+
+import "fmt"
+
+// invalidateChannel is where RESP2 clients receive CLIENT TRACKING
+// invalidations, through a connection redirected to and subscribed to it
+const invalidateChannel = "__redis__:invalidate"
+
+// commands a RESP2 client can still send once it is subscribed, everything
+// else would interleave its reply with the messages
+var pubsubContextCommands = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ssubscribe":   true,
+	"sunsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+	"reset":        true,
+}
+
+func pubsubContextError(name string) ErrorReply {
+	return ErrorReply(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", name))
+}
+
+// SUBSCRIBE channel [channel ...]
+func (h *RedisServer) handleSUBSCRIBE(c *Client, args []string) error {
+	for _, channel := range args {
+		h.pubsubMu.Lock()
+		subscribers, ok := h.channels[channel]
+		if !ok {
+			subscribers = make(map[int64]*Client)
+			h.channels[channel] = subscribers
+		}
+		subscribers[c.ID] = c
+		h.pubsubMu.Unlock()
+
+		c.mu.Lock()
+		c.channels[channel] = true
+		c.flags |= ClientPubSub
+		count := len(c.channels)
+		c.mu.Unlock()
+
+		c.WriteReply(Push{BulkString("subscribe"), BulkString(channel), Integer(count)})
+	}
+	return nil
+}
+
+// UNSUBSCRIBE [channel [channel ...]]
+func (h *RedisServer) handleUNSUBSCRIBE(c *Client, args []string) error {
+	if len(args) == 0 {
+		h.unsubscribeAll(c, true)
+		return nil
+	}
+	for _, channel := range args {
+		h.unsubscribe(c, channel, true)
+	}
+	return nil
+}
+
+// unsubscribeAll drops every subscription, confirming each one when reply is
+// set, and a client without any still gets a single confirmation like in Redis
+func (h *RedisServer) unsubscribeAll(c *Client, reply bool) {
+	c.mu.Lock()
+	channels := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		channels = append(channels, channel)
+	}
+	c.mu.Unlock()
+
+	if len(channels) == 0 && reply {
+		c.WriteReply(Push{BulkString("unsubscribe"), NullBulk{}, Integer(0)})
+		return
+	}
+	for _, channel := range channels {
+		h.unsubscribe(c, channel, reply)
+	}
+}
+
+func (h *RedisServer) unsubscribe(c *Client, channel string, reply bool) {
+	h.pubsubMu.Lock()
+	if subscribers, ok := h.channels[channel]; ok {
+		delete(subscribers, c.ID)
+		if len(subscribers) == 0 {
+			delete(h.channels, channel)
+		}
+	}
+	h.pubsubMu.Unlock()
+
+	c.mu.Lock()
+	delete(c.channels, channel)
+	count := len(c.channels)
+	if count == 0 {
+		c.flags &^= ClientPubSub
+	}
+	c.mu.Unlock()
+
+	if reply {
+		c.WriteReply(Push{BulkString("unsubscribe"), BulkString(channel), Integer(count)})
+	}
+}
+
+// PUBLISH channel message
+func (h *RedisServer) handlePUBLISH(c *Client, args []string) error {
+	return c.WriteReply(Integer(h.publish(args[0], BulkString(args[1]))))
+}
+
+// publish sends a message to every subscriber of channel and returns how many
+// received it. The message is usually a bulk string, invalidations are arrays.
+func (h *RedisServer) publish(channel string, message Reply) int {
+	h.pubsubMu.RLock()
+	subscribers := make([]*Client, 0, len(h.channels[channel]))
+	for _, sub := range h.channels[channel] {
+		subscribers = append(subscribers, sub)
+	}
+	h.pubsubMu.RUnlock()
+
+	for _, sub := range subscribers {
+		sub.WritePush(Push{BulkString("message"), BulkString(channel), message})
+		sub.Flush()
+	}
+	return len(subscribers)
+}
+
+// inPubSubContext is true for a RESP2 client with subscriptions, RESP3 ones
+// can mix push messages and replies freely
+func (c *Client) inPubSubContext() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Proto == 2 && c.flags&ClientPubSub != 0
+}
+
+// pubsubPing is PING inside the RESP2 pub/sub context, where the reply has to
+// look like a message
+func pubsubPing(args []string) Reply {
+	msg := ""
+	if len(args) > 0 {
+		msg = args[0]
+	}
+	return Array{BulkString("pong"), BulkString(msg)}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRDBRoundTrip(t *testing.T) {
+	soon := time.Now().Add(time.Hour).UnixMilli()
+	entries := []snapshotEntry{
+		{key: "empty", value: ""},
+		{key: "short", value: "v"},
+		{key: "binary", value: "\x00\xff\r\n\x80"},
+		// the last lengths of the 6 bit, 14 bit and 32 bit size encodings
+		// and the first ones past them
+		{key: "len63", value: strings.Repeat("a", 63)},
+		{key: "len64", value: strings.Repeat("b", 64)},
+		{key: "len16383", value: strings.Repeat("c", 16383)},
+		{key: "len16384", value: strings.Repeat("d", 16384)},
+		{key: "len100000", value: strings.Repeat("e", 100000)},
+		{key: strings.Repeat("k", 20000), value: "long key"},
+		{key: "expires", value: "soon", expiry: soon},
+		{key: "expires-2100", value: strings.Repeat("f", 70000), expiry: 4102444800123},
+	}
+
+	ram := NewSafeMap()
+	for _, e := range entries {
+		ram.Set(e.key, e.value, e.expiry)
+	}
+	// already expired keys are not written at all
+	ram.Set("expired", "v", time.Now().Add(-time.Second).UnixMilli())
+
+	fileName := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := NewRDBHandler(ram).Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSafeMap()
+	keys, err := NewRDBHandler(loaded).loadRdbFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(entries) {
+		t.Errorf("loaded %d keys, want %d", len(keys), len(entries))
+	}
+
+	got := loaded.Snapshot()
+	sort.Slice(got, func(i, j int) bool { return got[i].key < got[j].key })
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	if !reflect.DeepEqual(got, entries) {
+		for i := range min(len(got), len(entries)) {
+			if got[i] != entries[i] {
+				t.Errorf("entry %d: key %.20q expiry %d value of %d bytes, want key %.20q expiry %d value of %d bytes",
+					i, got[i].key, got[i].expiry, len(got[i].value), entries[i].key, entries[i].expiry, len(entries[i].value))
+			}
+		}
+		t.Fatalf("loaded %d entries, want %d", len(got), len(entries))
+	}
+}
+
+func TestRDBEmptyRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "dump.rdb")
+	if err := NewRDBHandler(NewSafeMap()).Save(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewSafeMap()
+	if _, err := NewRDBHandler(loaded).loadRdbFile(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(loaded.Snapshot()); n != 0 {
+		t.Errorf("loaded %d keys from an empty dump", n)
+	}
+}
+
+func TestSizeEncoding(t *testing.T) {
+	sizes := []uint64{0, 1, 63, 64, 16383, 16384, 1<<32 - 1, 1 << 32, 1<<63 - 1}
+
+	r := NewRDBHandler(NewSafeMap())
+	for _, n := range sizes {
+		var buf bytes.Buffer
+		writeSizeEncoding(&buf, n)
+		got, err := r.readSizeEncoding(bufio.NewReader(&buf))
+		if err != nil || got != n {
+			t.Errorf("size %d read back as %d, %v", n, got, err)
+		}
+	}
+}
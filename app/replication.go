@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,7 +22,7 @@ the replica should be using this function
 func (r *RedisServer) startReplication() {
 	for {
 		address := r.config.MasterAddr
-		conn, err := net.Dial("tcp", address)
+		conn, err := r.dialMaster(address)
 		if err != nil {
 			fmt.Printf("Failed to bind to %s\n, retrying", address)
 			time.Sleep(5 * time.Second)
@@ -26,6 +31,7 @@ func (r *RedisServer) startReplication() {
 
 		err = r.setUpReplication(conn)
 		if err != nil {
+			conn.Close()
 			fmt.Printf("Failed to set up replication %s", address)
 			time.Sleep(5 * time.Second)
 			continue
@@ -43,6 +49,20 @@ func (r *RedisServer) startReplication() {
 	}
 }
 
+// dialMaster opens the replication link, over TLS when tls-replication is on
+func (r *RedisServer) dialMaster(address string) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAliveConfig: r.config.keepAliveConfig()}
+	if !r.config.TLSReplication {
+		return dialer.Dial("tcp", address)
+	}
+
+	tlsConfig, err := r.config.replicationTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+}
+
 /*
 Who should be using this function?
 
@@ -53,43 +73,59 @@ Masters don't connect to replicas; the connection is always initiated by the rep
 func (r *RedisServer) setUpReplication(conn net.Conn) error {
 
 	r.sendPING(conn)
-	r.sendREPLCONF(conn, os.Args[2])
-	r.sendPSYNC(conn)
-
-	return nil
+	if r.config.MasterAuth != "" {
+		r.sendAUTH(conn)
+	}
+	r.sendREPLCONF(conn, r.config.Port)
+	return r.sendPSYNC(conn)
 }
 
-func (r *RedisServer) processReplicationStream(conn net.Conn) error {
+func (r *RedisServer) processReplicationStream(conn net.Conn) (err error) {
+	// recovering here turns a bad command from the master into a reconnect
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Panic applying the replication stream: %v\n%s", rec, debug.Stack())
+			err = fmt.Errorf("panic applying the replication stream: %v", rec)
+		}
+	}()
+
+	master := r.newClient(conn)
+	master.flags |= ClientMaster
+	// requirepass is for clients, the master link never sends AUTH
+	master.Authenticated = true
+	master.reader.limits = readLimits{}
+	defer master.closeOutput()
+	r.registerClient(master)
+	defer r.unregisterClient(master)
+
 	for {
-		cmds_bytes, err := r.readResponse(conn)
-		fmt.Printf("\n Cmd_bytes: %s  Length %d \n", string(cmds_bytes), len(cmds_bytes))
+		cmds, lengths, err := master.reader.ReadCommands()
 		if err != nil {
 			if err != io.EOF {
 				fmt.Printf("Error reading command: %v", err)
-				return err
 			}
-		}
-
-		//parsing the cmds to bytes so they can be used properly
-		cmds, lengths, err := r.protocol.parseArrays(cmds_bytes)
-		// fmt.Printf("%v", cmds)
-		if err != nil {
 			return err
 		}
 
 		// process each command
 		for i := 0; i < len(cmds); i++ {
-			cmd := cmds[i][0]
+			if len(cmds[i]) == 0 {
+				continue
+			}
+			cmd := strings.ToUpper(cmds[i][0])
 			args := cmds[i][1:]
 
 			// execute the command
-			r.ExecuteReplicaCmd(conn, cmd, args)
+			r.ExecuteCmd(master, cmd, args)
 
 			r.config.mu.Lock()
 			r.config.MasterReplOffset += lengths[i]
 			r.config.mu.Unlock()
 		}
 
+		if err := master.Flush(); err != nil {
+			return err
+		}
 	}
 }
 
@@ -113,7 +149,17 @@ func (r *RedisServer) readResponseUntil(conn net.Conn, val int) ([]byte, error)
 
 func (r *RedisServer) sendPING(conn net.Conn) error {
 	cmd := []string{"PING"}
-	_, err := conn.Write([]byte(r.protocol.stringToArray(cmd)))
+	_, err := conn.Write(r.protocol.encodeCommand(cmd))
+	if err != nil {
+		return err
+	}
+	r.readResponse(conn)
+	return err
+}
+
+func (r *RedisServer) sendAUTH(conn net.Conn) error {
+	cmd := []string{"AUTH", r.config.MasterAuth}
+	_, err := conn.Write(r.protocol.encodeCommand(cmd))
 	if err != nil {
 		return err
 	}
@@ -124,14 +170,14 @@ func (r *RedisServer) sendPING(conn net.Conn) error {
 func (r *RedisServer) sendREPLCONF(conn net.Conn, localPort string) error {
 	// since os
 	cmd := []string{"REPLCONF", "listening-port", localPort}
-	_, err := conn.Write([]byte(r.protocol.stringToArray(cmd)))
+	_, err := conn.Write(r.protocol.encodeCommand(cmd))
 	if err != nil {
 		return err
 	}
 	r.readResponse(conn)
 	//HARDCODED
 	cmd = []string{"REPLCONF", "capa", "psync2"}
-	_, err = conn.Write([]byte(r.protocol.stringToArray(cmd)))
+	_, err = conn.Write(r.protocol.encodeCommand(cmd))
 
 	r.readResponse(conn)
 
@@ -140,28 +186,64 @@ func (r *RedisServer) sendREPLCONF(conn net.Conn, localPort string) error {
 }
 func (r *RedisServer) sendPSYNC(conn net.Conn) error {
 	cmd := []string{"PSYNC", "?", "-1"}
-	_, err := conn.Write([]byte(r.protocol.stringToArray(cmd)))
+	_, err := conn.Write(r.protocol.encodeCommand(cmd))
 	if err != nil {
 		return err
 	}
-	// HARDCODED
-	// this is the empty file + set cmds actually so i have to parse the file properly
-	r.readRDBFile(conn)
-
-	return err
+	return r.readRDBFile(conn)
 }
 
-func (r *RedisServer) readRDBFile(conn net.Conn) {
-
-	// full resync + rdb file
-	r.readResponseUntil(conn, 56)
-
-	// fmt.Printf("resync: %s, Length %d", string(resync), len(resync))
+// readRDBFile reads the FULLRESYNC line and the RDB payload after it. Nothing
+// past the payload may be consumed, the replication stream starts right there
+// and is read by processReplicationStream.
+func (r *RedisServer) readRDBFile(conn net.Conn) error {
+	line, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	// +FULLRESYNC <replid> <offset>
+	fields := strings.Fields(strings.TrimPrefix(line, "+"))
+	if len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		return fmt.Errorf("unexpected reply to PSYNC: %q", line)
+	}
+	offset, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return fmt.Errorf("invalid offset in FULLRESYNC: %q", line)
+	}
 
-	r.readResponseUntil(conn, 93)
+	header, err := readLine(conn)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.Atoi(strings.TrimPrefix(header, "$"))
+	if err != nil || !strings.HasPrefix(header, "$") {
+		return fmt.Errorf("unexpected RDB header: %q", header)
+	}
+	if _, err := io.CopyN(io.Discard, conn, int64(size)); err != nil {
+		return fmt.Errorf("failed to read RDB payload: %w", err)
+	}
 
-	// fmt.Printf("rdb file: %s, Length %d", string(rdb), len(rdb))
+	r.config.mu.Lock()
+	r.config.MasterReplid = fields[1]
+	r.config.MasterReplOffset = offset
+	r.config.mu.Unlock()
+	return nil
+}
 
+// readLine reads a single CRLF terminated line one byte at a time, so not a
+// byte more than the line is taken off the connection
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", fmt.Errorf("failed to read response: %w", err)
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
 }
 
 // SaveRDBToFile saves RDB data to a file
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"math"
+	"strconv"
+)
+
+// Reply is anything a command can send back. Handlers build a tree of these
+// and ProtocolHandler.writeReply turns it into RESP2 or RESP3 depending on
+// what the connection negotiated with HELLO.
+type Reply interface {
+	reply()
+}
+
+type SimpleString string
+
+// ErrorReply holds the message without the leading '-', starting with the
+// error code, e.g. "ERR syntax error" or "WRONGTYPE ...".
+type ErrorReply string
+
+type Integer int64
+
+type BulkString string
+
+// NullBulk is the missing value reply, $-1 in RESP2.
+type NullBulk struct{}
+
+// NullArray is the missing array reply, *-1 in RESP2.
+type NullArray struct{}
+
+type Array []Reply
+
+// Map holds keys and values alternating. RESP2 has no map type and gets the
+// flat array clients already know how to pair up.
+type Map []Reply
+
+type Set []Reply
+
+// Push is out of band data such as invalidation messages. RESP2 clients only
+// understand it as the array pub/sub messages are sent as.
+type Push []Reply
+
+type Double float64
+
+type Boolean bool
+
+type BigNumber string
+
+// Verbatim tags text with a three letter format such as "txt" or "mkd" so
+// RESP3 clients can display it without escaping.
+type Verbatim struct {
+	Format string
+	Text   string
+}
+
+func (SimpleString) reply() {}
+func (ErrorReply) reply()   {}
+func (Integer) reply()      {}
+func (BulkString) reply()   {}
+func (NullBulk) reply()     {}
+func (NullArray) reply()    {}
+func (Array) reply()        {}
+func (Map) reply()          {}
+func (Set) reply()          {}
+func (Push) reply()         {}
+func (Double) reply()       {}
+func (Boolean) reply()      {}
+func (BigNumber) reply()    {}
+func (Verbatim) reply()     {}
+
+// OK is the reply most write commands send
+var OK = SimpleString("OK")
+
+// BulkStrings is a shorthand for the very common array of bulk strings
+func BulkStrings(values []string) Array {
+	arr := make(Array, len(values))
+	for i, v := range values {
+		arr[i] = BulkString(v)
+	}
+	return arr
+}
+
+// replyWriter is satisfied by the *bytes.Buffer client output is queued in.
+type replyWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// writeReply is the single encoder for every reply type. Write errors are not
+// returned, a bytes.Buffer never fails and socket errors surface on Flush.
+func (p *ProtocolHandler) writeReply(w replyWriter, proto int, v Reply) {
+	switch v := v.(type) {
+	case SimpleString:
+		writeLine(w, '+', string(v))
+	case ErrorReply:
+		writeLine(w, '-', string(v))
+	case Integer:
+		writeLine(w, ':', strconv.FormatInt(int64(v), 10))
+	case BulkString:
+		writeLine(w, '$', strconv.Itoa(len(v)))
+		w.WriteString(string(v))
+		w.WriteString("\r\n")
+	case NullBulk:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case NullArray:
+		if proto == 3 {
+			w.WriteString("_\r\n")
+		} else {
+			w.WriteString("*-1\r\n")
+		}
+	case Array:
+		p.writeAggregate(w, proto, '*', len(v), v)
+	case Map:
+		if proto == 3 {
+			p.writeAggregate(w, proto, '%', len(v)/2, v)
+		} else {
+			p.writeAggregate(w, proto, '*', len(v), v)
+		}
+	case Set:
+		if proto == 3 {
+			p.writeAggregate(w, proto, '~', len(v), v)
+		} else {
+			p.writeAggregate(w, proto, '*', len(v), v)
+		}
+	case Push:
+		if proto == 3 {
+			p.writeAggregate(w, proto, '>', len(v), v)
+		} else {
+			p.writeAggregate(w, proto, '*', len(v), v)
+		}
+	case Double:
+		s := formatDouble(float64(v))
+		if proto == 3 {
+			writeLine(w, ',', s)
+		} else {
+			p.writeReply(w, proto, BulkString(s))
+		}
+	case Boolean:
+		if proto == 3 {
+			if v {
+				w.WriteString("#t\r\n")
+			} else {
+				w.WriteString("#f\r\n")
+			}
+		} else if v {
+			w.WriteString(":1\r\n")
+		} else {
+			w.WriteString(":0\r\n")
+		}
+	case BigNumber:
+		if proto == 3 {
+			writeLine(w, '(', string(v))
+		} else {
+			p.writeReply(w, proto, BulkString(v))
+		}
+	case Verbatim:
+		if proto == 3 {
+			writeLine(w, '=', strconv.Itoa(len(v.Format)+1+len(v.Text)))
+			w.WriteString(v.Format)
+			w.WriteByte(':')
+			w.WriteString(v.Text)
+			w.WriteString("\r\n")
+		} else {
+			p.writeReply(w, proto, BulkString(v.Text))
+		}
+	}
+}
+
+func (p *ProtocolHandler) writeAggregate(w replyWriter, proto int, prefix byte, length int, items []Reply) {
+	writeLine(w, prefix, strconv.Itoa(length))
+	for _, item := range items {
+		p.writeReply(w, proto, item)
+	}
+}
+
+func writeLine(w replyWriter, prefix byte, line string) {
+	w.WriteByte(prefix)
+	w.WriteString(line)
+	w.WriteString("\r\n")
+}
+
+func formatDouble(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "inf"
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsNaN(v):
+		return "nan"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
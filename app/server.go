@@ -1,13 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type RedisServer struct {
@@ -15,15 +21,30 @@ type RedisServer struct {
 	protocol   *ProtocolHandler
 	ram        *SafeMap
 	rdb        *RDBHandler
-	listener   net.Listener
-	clients    map[string]*Client
-	replica    map[string]net.Conn
+	listeners  []net.Listener
+	clients    map[int64]*Client
+	clientsMu  sync.RWMutex
+	replica    map[string]*Client
+	commands   map[string]*Command
 	replicasMu sync.RWMutex // there so you don't accidentally delete a replica while its handling a cmd
-}
 
-type Client struct {
-	Conn net.Conn
-	ID   string
+	nextClientID atomic.Int64
+	pause        *pauseState
+	tracking     *trackingTable
+
+	// shutdownAbort is set while a shutdown is in progress, closing it makes
+	// SHUTDOWN ABORT stop the wait for replicas
+	shutdownAbort    chan struct{}
+	shutdownMu       sync.Mutex
+	closingListeners atomic.Bool
+
+	channels map[string]map[int64]*Client // pub/sub subscribers by channel
+	pubsubMu sync.RWMutex
+
+	// connection counters reported by INFO
+	connectedClients    atomic.Int64
+	totalConnections    atomic.Int64
+	rejectedConnections atomic.Int64
 }
 
 func NewRedisServer(
@@ -32,36 +53,167 @@ func NewRedisServer(
 	ram *SafeMap,
 	rdb *RDBHandler,
 ) *RedisServer {
-	return &RedisServer{
+	s := &RedisServer{
 		config:   config,
 		protocol: protocol,
 		ram:      ram,
 		rdb:      rdb,
-		clients:  make(map[string]*Client),
-		replica:  make(map[string]net.Conn),
+		clients:  make(map[int64]*Client),
+		replica:  make(map[string]*Client),
+		pause:    newPauseState(),
+		tracking: newTrackingTable(),
+		channels: make(map[string]map[int64]*Client),
 	}
+	s.commands = s.buildCommandTable()
+	ram.expiryPaused = s.pause.Active
+	ram.onExpire = s.expiredKey
+
+	return s
 }
 
 func (s *RedisServer) StartServer() {
+	s.loadDataset()
 
-	ln, err := net.Listen("tcp", s.config.Addr)
-	if err != nil {
-		fmt.Printf("Failed to bind to %s\n", s.config.Addr)
-		os.Exit(1)
+	if s.config.Port != "0" {
+		s.listenTCP(s.config.Port, nil)
+	}
+
+	if s.config.TLSPort != "0" && s.config.TLSPort != "" {
+		tlsConfig, err := s.config.serverTLSConfig()
+		if err != nil {
+			fmt.Printf("Failed to configure TLS: %v\n", err)
+			os.Exit(1)
+		}
+		s.listenTCP(s.config.TLSPort, tlsConfig)
 	}
-	defer ln.Close()
 
-	s.listener = ln
+	if s.config.UnixSocket != "" {
+		ln, err := s.listenUnix(s.config.UnixSocket, s.config.UnixSocketPerm)
+		if err != nil {
+			fmt.Printf("Failed to open unix socket %s: %v\n", s.config.UnixSocket, err)
+			os.Exit(1)
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+
+	if len(s.listeners) == 0 {
+		fmt.Println("Nothing to listen on, port and tls-port are 0 and no unixsocket is set")
+		os.Exit(1)
+	}
 
 	// the replication manager just handles the replica <-> master communication
 	if s.config.Role == "slave" {
 		go s.startReplication()
 	}
 
-	s.acceptClient()
+	go s.clientsCron()
+	go s.handleSignals()
+	go s.replicationCron()
+
+	// every listener feeds the same acceptConnection
+	var wg sync.WaitGroup
+	for _, ln := range s.listeners {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			defer ln.Close()
+			s.acceptClient(ln)
+		}(ln)
+	}
+	wg.Wait()
+
+	// the listeners only close for a shutdown, which still has to close the
+	// clients and exits the process itself when it is done
+	select {}
+}
+
+// loadDataset reads the snapshot once at startup, a missing file just means
+// an empty dataset
+func (s *RedisServer) loadDataset() {
+	path := s.config.rdbPath()
+	if path == "" {
+		return
+	}
+	keys, err := s.rdb.loadRdbFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		fmt.Printf("Failed to load %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	log.Printf("DB loaded from disk: %d keys", len(keys))
+}
+
+// listenTCP opens a listener on port for every bind address. Failing on a
+// required address is fatal, an optional one (prefixed with -) is skipped when
+// the address or its family isn't available on this host.
+func (s *RedisServer) listenTCP(port string, tlsConfig *tls.Config) {
+	for _, bind := range s.config.Bind {
+		optional := strings.HasPrefix(bind, "-")
+		host := strings.TrimPrefix(bind, "-")
+
+		// * and ::* are the IPv4 and IPv6 wildcards, tcp4 and tcp6 keep them
+		// from being dual stack so both can be bound on the same port
+		network := "tcp"
+		switch {
+		case host == "*":
+			host, network = "0.0.0.0", "tcp4"
+		case host == "::*":
+			host, network = "::", "tcp6"
+		case net.ParseIP(host) != nil && net.ParseIP(host).To4() != nil:
+			network = "tcp4"
+		case net.ParseIP(host) != nil:
+			network = "tcp6"
+		}
+
+		addr := net.JoinHostPort(host, port)
+		ln, err := net.Listen(network, addr)
+		if err != nil {
+			if optional && isUnavailableAddr(err) {
+				log.Printf("Skipping optional bind address %s: %v", addr, err)
+				continue
+			}
+			fmt.Printf("Failed to bind to %s: %v\n", addr, err)
+			os.Exit(1)
+		}
+
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+}
+
+// isUnavailableAddr matches the errors Redis tolerates for optional binds,
+// the address isn't configured here or the protocol family isn't supported
+func isUnavailableAddr(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) ||
+		errors.Is(err, syscall.EAFNOSUPPORT) ||
+		errors.Is(err, syscall.EPROTONOSUPPORT) ||
+		errors.Is(err, syscall.ESOCKTNOSUPPORT) ||
+		errors.Is(err, syscall.ENOPROTOOPT)
 }
 
-func (s *RedisServer) acceptClient() {
+func (s *RedisServer) listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	// a socket file left behind by a previous run would make the bind fail
+	os.Remove(path)
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func (s *RedisServer) acceptClient(listener net.Listener) {
 	/*
 		The client must
 		1. StartReplication and talk to master for state updates
@@ -77,14 +229,44 @@ func (s *RedisServer) acceptClient() {
 	*/
 
 	//handle client, you're accepting a client here
+	var delay time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
-			os.Exit(1)
+			if s.closingListeners.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// running out of file descriptors or a connection reset before we
+			// got to it, wait a little and keep serving everyone else
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("Accepting client connection: %v, retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
 		}
+		delay = 0
 
-		go s.acceptConnection(conn)
+		s.totalConnections.Add(1)
+
+		// counted here rather than in acceptConnection so a burst of
+		// connections can't all slip in before the first one registers
+		if s.connectedClients.Add(1) > int64(s.config.MaxClients) {
+			s.connectedClients.Add(-1)
+			s.rejectedConnections.Add(1)
+			// on TLS the write runs the handshake, which reads too, and a
+			// client that never answers must not hold up the accept loop
+			go func() {
+				conn.SetDeadline(time.Now().Add(time.Second))
+				conn.Write([]byte("-ERR max number of clients reached\r\n"))
+				conn.Close()
+			}()
+			continue
+		}
+
+		s.applyKeepAlive(conn)
+		go func() {
+			defer s.connectedClients.Add(-1)
+			s.acceptConnection(conn)
+		}()
 	}
 
 }
@@ -92,53 +274,121 @@ func (s *RedisServer) acceptClient() {
 func (s *RedisServer) acceptConnection(conn net.Conn) {
 	defer conn.Close()
 
+	client := s.newClient(conn)
+	defer client.closeOutput()
+	s.registerClient(client)
+	defer s.unregisterClient(client)
+
+	// a bug in one command handler must not take the whole server down, the
+	// client that triggered it gets an error and is disconnected
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic serving client %d (%s): %v\n%s", client.ID, conn.RemoteAddr(), r, debug.Stack())
+			client.WriteReply(ErrorReply("ERR internal error while executing the command"))
+			client.Flush()
+		}
+	}()
+
 	for {
-		// Constraits: arguments cannot be longer than 2048 bytes
-		cmdArgs, err := s.protocol.readCommands(conn)
+		cmds, _, err := client.reader.ReadCommands()
+		client.setQueryBuf(client.reader.Buffered(), cap(client.reader.buf))
 
 		if err != nil {
-			if err != io.EOF {
+			var protoErr ProtocolError
+			if errors.As(err, &protoErr) {
+				client.WriteReply(ErrorReply("ERR " + protoErr.Error()))
+				client.Flush()
+			}
+			// a connection we closed ourselves, on shutdown or CLIENT KILL,
+			// is not worth a log line
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				log.Printf("Error reading command: %v", err)
 			}
 			return
 		}
 
-		if len(cmdArgs) == 0 {
-			log.Printf("Empty command received")
-			continue
-		}
+		// every command that arrived in this read is executed before any reply
+		// goes out, so a pipeline costs one write instead of one per command
+		for _, cmdArgs := range cmds {
+			if len(cmdArgs) == 0 {
+				log.Printf("Empty command received")
+				continue
+			}
 
-		cmd := strings.ToUpper(cmdArgs[0])
+			cmd := strings.ToUpper(cmdArgs[0])
 
-		if isWrite(cmd) && s.config.Role == "slave" {
-			log.Printf("Cannot propagate write cmd to Read only replica")
-		}
+			err = s.ExecuteCmd(client, cmd, cmdArgs[1:])
 
-		s.ExecuteCmd(conn, cmd, cmdArgs[1:])
+			if err != nil {
+				log.Printf("Error handling command %s: %v", cmd, err)
+				client.Flush()
+				return
+			}
 
-		if isWrite(cmd) && s.config.Role == "master" {
-			s.propagateWrite(s.replica, cmdArgs)
+			// nothing queued after CLIENT KILL on ourselves gets to run
+			if client.hasFlag(ClientCloseAfterReply) {
+				break
+			}
 		}
 
-		if err != nil {
-			log.Printf("Error handling command %s: %v", cmd, err)
+		if err := client.Flush(); err != nil {
+			log.Printf("Error writing replies: %v", err)
+			return
+		}
+
+		if client.hasFlag(ClientCloseAfterReply) {
 			return
 		}
 	}
 }
 
-// replica id then forward the cmd
-func (s *RedisServer) propagateWrite(replica map[string]net.Conn, cmds []string) {
+// propagateWrite queues the command on every replica, the write itself
+// happens on the replica's own writeLoop so a stuck replica can't block us
+func (s *RedisServer) propagateWrite(replica map[string]*Client, cmds []string) {
+	s.replicasMu.RLock()
+	defer s.replicasMu.RUnlock()
+
+	payload := s.protocol.encodeCommand(cmds)
+
+	s.config.mu.Lock()
+	s.config.MasterReplOffset += len(payload)
+	s.config.mu.Unlock()
+
 	for _, v := range replica {
-		v.Write([]byte(s.protocol.stringToArray(cmds)))
+		v.Write(payload)
+		v.Flush()
 	}
 }
 
-func (s *RedisServer) AddReplica(id string, conn net.Conn) {
-	s.replicasMu.Lock()
-	defer s.replicasMu.Unlock()
+// replicationCron pings the replicas every repl-ping-replica-period seconds
+// so they can tell a quiet master from a dead link. The ping is skipped during
+// CLIENT PAUSE, it would move the offset replicas are meant to catch up to.
+func (s *RedisServer) replicationCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var elapsed int
+	for range ticker.C {
+		elapsed++
+
+		s.config.mu.RLock()
+		period := s.config.ReplPingReplicaPeriod
+		s.config.mu.RUnlock()
+
+		if s.config.Role != "master" || period <= 0 || elapsed < period {
+			continue
+		}
+		elapsed = 0
+
+		s.replicasMu.RLock()
+		replicas := len(s.replica)
+		s.replicasMu.RUnlock()
 
-	s.replica[id] = conn
+		if replicas == 0 || s.pause.Active() {
+			continue
+		}
+		s.propagateWrite(s.replica, []string{"PING"})
+	}
 }
 
 // RemoveReplica removes a replica connection
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// newTestServer is a master with an empty dataset and default config, nothing
+// is listening
+func newTestServer(t *testing.T) *RedisServer {
+	t.Helper()
+	ram := NewSafeMap()
+	return NewRedisServer(parseArgs(nil), NewProtocolHandler(), ram, NewRDBHandler(ram))
+}
+
+// newTestClient connects a client over a pipe nobody reads from, replies are
+// taken straight from its output queue by run
+func newTestClient(t *testing.T, s *RedisServer) *Client {
+	t.Helper()
+	conn, peer := net.Pipe()
+	c := s.newClient(conn)
+	t.Cleanup(func() {
+		c.closeOutput()
+		conn.Close()
+		peer.Close()
+	})
+	return c
+}
+
+// run executes a command and returns its reply as RESP
+func run(s *RedisServer, c *Client, args ...string) string {
+	s.ExecuteCmd(c, strings.ToUpper(args[0]), args[1:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reply := c.out.String()
+	c.out.Reset()
+	return reply
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type shutdownOptions struct {
+	save   bool // save even without persistence configured
+	noSave bool
+	now    bool // don't wait for lagging replicas
+	force  bool // exit even if the final save fails
+}
+
+var (
+	errShutdownAborted    = errors.New("shutdown aborted")
+	errShutdownInProgress = errors.New("shutdown already in progress")
+)
+
+// SHUTDOWN [NOSAVE|SAVE] [NOW] [FORCE] [ABORT]
+func (h *RedisServer) handleSHUTDOWN(c *Client, args []string) error {
+	var opts shutdownOptions
+	abort := false
+
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "NOSAVE":
+			opts.noSave = true
+		case "SAVE":
+			opts.save = true
+		case "NOW":
+			opts.now = true
+		case "FORCE":
+			opts.force = true
+		case "ABORT":
+			abort = true
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+	if (opts.save && opts.noSave) || (abort && len(args) > 1) {
+		return c.WriteReply(ErrorReply("ERR syntax error"))
+	}
+
+	if abort {
+		if !h.abortShutdown() {
+			return c.WriteReply(ErrorReply("ERR No shutdown in progress."))
+		}
+		return c.WriteReply(OK)
+	}
+
+	log.Printf("User requested shutdown...")
+	// a successful shutdown never returns, the client just sees the
+	// connection close
+	h.shutdown(opts)
+	return c.WriteReply(ErrorReply("ERR Errors trying to SHUTDOWN. Check logs."))
+}
+
+// handleSignals shuts down on SIGTERM and SIGINT the same way a plain
+// SHUTDOWN does. A second SIGINT while that is in progress exits right away.
+func (s *RedisServer) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	for sig := range signals {
+		name := "SIGTERM"
+		if sig == syscall.SIGINT {
+			name = "SIGINT"
+			if s.shutdownInProgress() {
+				log.Printf("You insist... exiting now.")
+				os.Exit(1)
+			}
+		}
+
+		log.Printf("Received %s scheduling shutdown...", name)
+		go func() {
+			if err := s.shutdown(shutdownOptions{}); err != nil {
+				log.Printf("Errors trying to shut down the server. Check the logs for more information.")
+			}
+		}()
+	}
+}
+
+func (s *RedisServer) shutdownInProgress() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+	return s.shutdownAbort != nil
+}
+
+// shutdown waits for the replicas, saves, stops listening, closes every client
+// and exits. It only returns when something stopped it, and then the server
+// keeps running as if nothing happened.
+func (s *RedisServer) shutdown(opts shutdownOptions) error {
+	s.shutdownMu.Lock()
+	if s.shutdownAbort != nil {
+		s.shutdownMu.Unlock()
+		log.Printf("Shutdown already in progress, ignoring the new request.")
+		return errShutdownInProgress
+	}
+	abort := make(chan struct{})
+	s.shutdownAbort = abort
+	s.shutdownMu.Unlock()
+
+	cancel := func() {
+		s.shutdownMu.Lock()
+		if s.shutdownAbort == abort {
+			s.shutdownAbort = nil
+		}
+		s.shutdownMu.Unlock()
+	}
+
+	if !opts.now && !s.waitForReplicas(abort) {
+		cancel()
+		return errShutdownAborted
+	}
+
+	path := s.config.rdbPath()
+	if opts.save && path == "" {
+		path = "dump.rdb"
+	}
+	if !opts.noSave && path != "" {
+		log.Printf("Saving the final RDB snapshot before exiting.")
+		if err := s.rdb.Save(path); err != nil {
+			if !opts.force {
+				log.Printf("Error trying to save the DB, can't exit: %v", err)
+				s.pause.Unpause(pauseDuringShutdown)
+				cancel()
+				return err
+			}
+			log.Printf("Error trying to save the DB. Exit anyway: %v", err)
+		} else {
+			log.Printf("DB saved on disk")
+		}
+	}
+
+	s.closeListeners()
+	s.closeClients()
+
+	log.Printf("Redis is now ready to exit, bye bye...")
+	os.Exit(0)
+	return nil
+}
+
+// abortShutdown cancels a shutdown that is still waiting for its replicas
+func (s *RedisServer) abortShutdown() bool {
+	s.shutdownMu.Lock()
+	defer s.shutdownMu.Unlock()
+
+	if s.shutdownAbort == nil {
+		return false
+	}
+	close(s.shutdownAbort)
+	s.shutdownAbort = nil
+	s.pause.Unpause(pauseDuringShutdown)
+	log.Printf("Shutdown manually aborted.")
+	return true
+}
+
+// waitForReplicas gives the replicas up to shutdown-timeout seconds to
+// acknowledge everything written so far. Writes are paused meanwhile so the
+// offset they are catching up to holds still. False means it was aborted.
+func (s *RedisServer) waitForReplicas(abort chan struct{}) bool {
+	s.config.mu.RLock()
+	timeout := time.Duration(s.config.ShutdownTimeout) * time.Second
+	target := s.config.MasterReplOffset
+	s.config.mu.RUnlock()
+
+	s.replicasMu.RLock()
+	replicas := len(s.replica)
+	s.replicasMu.RUnlock()
+
+	if s.config.Role != "master" || replicas == 0 || timeout == 0 {
+		return true
+	}
+
+	deadline := time.Now().Add(timeout)
+	s.pause.Pause(pauseDuringShutdown, deadline, false)
+
+	// asks for an ACK now instead of waiting for one, the GETACK itself is
+	// not part of what they have to catch up to
+	log.Printf("Waiting for replicas before shutting down.")
+	s.propagateWrite(s.replica, []string{"REPLCONF", "GETACK", "*"})
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		lagging := s.laggingReplicas(target)
+		if len(lagging) == 0 {
+			log.Printf("All replicas are in sync.")
+			return true
+		}
+
+		select {
+		case <-abort:
+			return false
+		case <-timer.C:
+			for addr, lag := range lagging {
+				log.Printf("Lagging replica %s reported offset %d behind master.", addr, lag)
+			}
+			return true
+		case <-ticker.C:
+		}
+	}
+}
+
+// laggingReplicas maps the address of every replica that hasn't acknowledged
+// target yet to how many bytes it is behind
+func (s *RedisServer) laggingReplicas(target int) map[string]int {
+	s.replicasMu.RLock()
+	defer s.replicasMu.RUnlock()
+
+	lagging := make(map[string]int)
+	for addr, replica := range s.replica {
+		replica.mu.Lock()
+		acked := replica.replAckOffset
+		replica.mu.Unlock()
+		if acked < target {
+			lagging[addr] = target - acked
+		}
+	}
+	return lagging
+}
+
+// closeListeners stops accepting connections, a unix socket file is removed
+func (s *RedisServer) closeListeners() {
+	s.closingListeners.Store(true)
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	if s.config.UnixSocket != "" {
+		os.Remove(s.config.UnixSocket)
+	}
+}
+
+// closeClients writes out whatever is still queued for every client, replicas
+// included, and closes their connections
+func (s *RedisServer) closeClients() {
+	var wg sync.WaitGroup
+	for _, c := range s.Clients() {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.closeOutput()
+			c.Conn.Close()
+		}(c)
+	}
+	wg.Wait()
+}
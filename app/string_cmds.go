@@ -0,0 +1,477 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// INCR key
+func (h *RedisServer) handleINCR(c *Client, args []string) error {
+	return h.incrBy(c, args[0], 1)
+}
+
+// DECR key
+func (h *RedisServer) handleDECR(c *Client, args []string) error {
+	return h.incrBy(c, args[0], -1)
+}
+
+// INCRBY key increment
+func (h *RedisServer) handleINCRBY(c *Client, args []string) error {
+	incr, ok := parseInt64(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+	return h.incrBy(c, args[0], incr)
+}
+
+// DECRBY key decrement
+func (h *RedisServer) handleDECRBY(c *Client, args []string) error {
+	decr, ok := parseInt64(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+	if decr == math.MinInt64 {
+		return c.WriteReply(ErrorReply("ERR decrement would overflow"))
+	}
+	return h.incrBy(c, args[0], -decr)
+}
+
+// incrBy adds incr to the integer stored at key in one step, a missing key
+// counts as 0 and the TTL of an existing one is kept
+func (h *RedisServer) incrBy(c *Client, key string, incr int64) error {
+	var result int64
+	var errReply ErrorReply
+	h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		var cur int64
+		if exists {
+			var ok bool
+			if cur, ok = parseInt64(value); !ok {
+				errReply = "ERR value is not an integer or out of range"
+				return "", 0, mutateNone
+			}
+		}
+		if (incr < 0 && cur < math.MinInt64-incr) || (incr > 0 && cur > math.MaxInt64-incr) {
+			errReply = "ERR increment or decrement would overflow"
+			return "", 0, mutateNone
+		}
+		result = cur + incr
+		return strconv.FormatInt(result, 10), expiry, mutateSet
+	})
+
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
+	return c.WriteReply(Integer(result))
+}
+
+// INCRBYFLOAT key increment
+func (h *RedisServer) handleINCRBYFLOAT(c *Client, args []string) error {
+	key := args[0]
+	incr, ok := parseFloat(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not a valid float"))
+	}
+
+	var result string
+	var errReply ErrorReply
+	op := h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		var cur float64
+		if exists {
+			var ok bool
+			if cur, ok = parseFloat(value); !ok {
+				errReply = "ERR value is not a valid float"
+				return "", 0, mutateNone
+			}
+		}
+		sum := cur + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			errReply = "ERR increment would produce NaN or Infinity"
+			return "", 0, mutateNone
+		}
+		result = strconv.FormatFloat(sum, 'f', -1, 64)
+		return result, expiry, mutateSet
+	})
+
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
+	// the replicas get the formatted result so float rounding can't make
+	// them drift from the master
+	if op == mutateSet {
+		c.propagate = []string{"SET", key, result, "KEEPTTL"}
+	}
+	return c.WriteReply(BulkString(result))
+}
+
+// errStringTooLong is what APPEND and SETRANGE reply when the result would be
+// longer than a client could send in one bulk string
+const errStringTooLong = ErrorReply("ERR string exceeds maximum allowed size (proto-max-bulk-len)")
+
+// defaultMaxStringLen is the proto-max-bulk-len default, the ceiling for
+// strings when that limit is turned off, or a single SETRANGE could ask for
+// more memory than the machine has
+const defaultMaxStringLen = 512 * 1024 * 1024
+
+// stringTooLong checks whether size plus extra goes over proto-max-bulk-len
+// without adding them, an offset from SETRANGE can be close to MaxInt64
+func (h *RedisServer) stringTooLong(size int64, extra int64) bool {
+	h.config.mu.RLock()
+	limit := int64(h.config.ProtoMaxBulkLen)
+	h.config.mu.RUnlock()
+	if limit <= 0 {
+		limit = defaultMaxStringLen
+	}
+	return size > limit-extra
+}
+
+// APPEND key value
+func (h *RedisServer) handleAPPEND(c *Client, args []string) error {
+	key, suffix := args[0], args[1]
+
+	var length int
+	var errReply ErrorReply
+	h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		if h.stringTooLong(int64(len(value)), int64(len(suffix))) {
+			errReply = errStringTooLong
+			return "", 0, mutateNone
+		}
+		length = len(value) + len(suffix)
+		return value + suffix, expiry, mutateSet
+	})
+
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
+	return c.WriteReply(Integer(length))
+}
+
+// STRLEN key
+func (h *RedisServer) handleSTRLEN(c *Client, args []string) error {
+	value, _ := h.lookupKey(c, args[0])
+	return c.WriteReply(Integer(len(value)))
+}
+
+// GETRANGE key start end, both inclusive and negative ones count from the end
+func (h *RedisServer) handleGETRANGE(c *Client, args []string) error {
+	start, ok1 := parseInt64(args[1])
+	end, ok2 := parseInt64(args[2])
+	if !ok1 || !ok2 {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+
+	value, _ := h.lookupKey(c, args[0])
+	length := int64(len(value))
+	if start < 0 && end < 0 && start > end {
+		return c.WriteReply(BulkString(""))
+	}
+	if start < 0 {
+		start = max(length+start, 0)
+	}
+	if end < 0 {
+		end = max(length+end, 0)
+	}
+	end = min(end, length-1)
+	if start > end || length == 0 {
+		return c.WriteReply(BulkString(""))
+	}
+	return c.WriteReply(BulkString(value[start : end+1]))
+}
+
+// SETRANGE key offset value, a missing key or a short value is padded with
+// zero bytes up to offset
+func (h *RedisServer) handleSETRANGE(c *Client, args []string) error {
+	key, patch := args[0], args[2]
+	offset, ok := parseInt64(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+	if offset < 0 {
+		return c.WriteReply(ErrorReply("ERR offset is out of range"))
+	}
+
+	var length int
+	var errReply ErrorReply
+	h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		length = len(value)
+		// an empty value changes nothing, not even a missing key is created
+		if patch == "" {
+			return "", 0, mutateNone
+		}
+		if h.stringTooLong(offset, int64(len(patch))) {
+			errReply = errStringTooLong
+			return "", 0, mutateNone
+		}
+
+		buf := []byte(value)
+		if end := int(offset) + len(patch); end > len(buf) {
+			buf = append(buf, make([]byte, end-len(buf))...)
+		}
+		copy(buf[offset:], patch)
+		length = len(buf)
+		return string(buf), expiry, mutateSet
+	})
+
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
+	return c.WriteReply(Integer(length))
+}
+
+// GETDEL key
+func (h *RedisServer) handleGETDEL(c *Client, args []string) error {
+	var old string
+	op := h.mutateKey(c, args[0], func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		if !exists {
+			return "", 0, mutateNone
+		}
+		old = value
+		return "", 0, mutateDelete
+	})
+
+	if op == mutateNone {
+		return c.WriteReply(NullBulk{})
+	}
+	return c.WriteReply(BulkString(old))
+}
+
+// GETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST]
+func (h *RedisServer) handleGETEX(c *Client, args []string) error {
+	key := args[0]
+	opts, errReply := parseSetOptions(args[1:], "getex")
+	if errReply != "" {
+		return c.WriteReply(errReply)
+	}
+
+	var old string
+	var found bool
+	op := h.mutateKey(c, key, func(value string, expiry int64, exists bool) (string, int64, mutation) {
+		old, found = value, exists
+		switch {
+		case !exists:
+			return "", 0, mutateNone
+		case opts.persist && expiry != 0:
+			return value, 0, mutateSet
+		case opts.expiry != 0:
+			return value, opts.expiry, mutateSet
+		}
+		return "", 0, mutateNone
+	})
+
+	// the replicas get a SET with the same value, which carries the absolute
+	// expiry or, without one, drops the TTL
+	if op == mutateSet {
+		c.propagate = []string{"SET", key, old}
+		if !opts.persist {
+			c.propagate = append(c.propagate, "PXAT", strconv.FormatInt(opts.expiry, 10))
+		}
+	}
+
+	if !found {
+		return c.WriteReply(NullBulk{})
+	}
+	return c.WriteReply(BulkString(old))
+}
+
+// GETSET key value
+func (h *RedisServer) handleGETSET(c *Client, args []string) error {
+	old, existed, _ := h.setGeneric(c, args[0], args[1], setOptions{})
+	if !existed {
+		return c.WriteReply(NullBulk{})
+	}
+	return c.WriteReply(BulkString(old))
+}
+
+// MGET key [key ...]
+func (h *RedisServer) handleMGET(c *Client, args []string) error {
+	values := make(Array, len(args))
+	for i, key := range args {
+		if value, ok := h.lookupKey(c, key); ok {
+			values[i] = BulkString(value)
+		} else {
+			values[i] = NullBulk{}
+		}
+	}
+	return c.WriteReply(values)
+}
+
+// MSET key value [key value ...]
+func (h *RedisServer) handleMSET(c *Client, args []string) error {
+	if len(args)%2 != 0 {
+		return c.WriteReply(wrongArgsError("mset"))
+	}
+	h.setKeys(c, args, false)
+	return c.WriteReply(OK)
+}
+
+// MSETNX key value [key value ...], sets all of them only if none exists
+func (h *RedisServer) handleMSETNX(c *Client, args []string) error {
+	if len(args)%2 != 0 {
+		return c.WriteReply(wrongArgsError("msetnx"))
+	}
+	if !h.setKeys(c, args, true) {
+		return c.WriteReply(Integer(0))
+	}
+	return c.WriteReply(Integer(1))
+}
+
+// SETNX key value
+func (h *RedisServer) handleSETNX(c *Client, args []string) error {
+	_, _, op := h.setGeneric(c, args[0], args[1], setOptions{nx: true})
+	if op == mutateNone {
+		return c.WriteReply(Integer(0))
+	}
+	return c.WriteReply(Integer(1))
+}
+
+// SETEX key seconds value
+func (h *RedisServer) handleSETEX(c *Client, args []string) error {
+	return h.setExpiring(c, "setex", "EX", args)
+}
+
+// PSETEX key milliseconds value
+func (h *RedisServer) handlePSETEX(c *Client, args []string) error {
+	return h.setExpiring(c, "psetex", "PX", args)
+}
+
+// setExpiring is SETEX and PSETEX, which are SET with EX or PX and the
+// arguments in another order
+func (h *RedisServer) setExpiring(c *Client, command string, unit string, args []string) error {
+	n, ok := parseInt64(args[1])
+	if !ok {
+		return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+	}
+	expiry, ok := expireAt(unit, n, time.Now().UnixMilli())
+	if !ok {
+		return c.WriteReply(invalidExpireError(command))
+	}
+
+	h.setGeneric(c, args[0], args[2], setOptions{expiry: expiry, relative: true})
+	return c.WriteReply(OK)
+}
+
+// LCS key1 key2 [LEN] [IDX] [MINMATCHLEN min-match-len] [WITHMATCHLEN]
+func (h *RedisServer) handleLCS(c *Client, args []string) error {
+	var getLen, getIdx, withMatchLen bool
+	var minMatchLen int64
+
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "LEN":
+			getLen = true
+		case opt == "IDX":
+			getIdx = true
+		case opt == "WITHMATCHLEN":
+			withMatchLen = true
+		case opt == "MINMATCHLEN" && i+1 < len(args):
+			i++
+			n, ok := parseInt64(args[i])
+			if !ok {
+				return c.WriteReply(ErrorReply("ERR value is not an integer or out of range"))
+			}
+			minMatchLen = max(n, 0)
+		default:
+			return c.WriteReply(ErrorReply("ERR syntax error"))
+		}
+	}
+	if getLen && getIdx {
+		return c.WriteReply(ErrorReply("ERR If you want both the length and indexes, please just use IDX."))
+	}
+
+	a, _ := h.lookupKey(c, args[0])
+	b, _ := h.lookupKey(c, args[1])
+
+	h.config.mu.RLock()
+	limit := h.config.LCSMaxMemory
+	h.config.mu.RUnlock()
+	// the table holds a uint32 for every pair of prefixes
+	if limit > 0 && uint64(len(a)+1)*uint64(len(b)+1) > uint64(limit)/4 {
+		return c.WriteReply(ErrorReply("ERR Insufficient memory, transient memory for LCS exceeds lcs-max-memory"))
+	}
+
+	lcs, matches := longestCommonSubsequence(a, b, minMatchLen)
+	switch {
+	case getLen:
+		return c.WriteReply(Integer(len(lcs)))
+	case !getIdx:
+		return c.WriteReply(BulkString(lcs))
+	}
+
+	ranges := make(Array, 0, len(matches))
+	for _, m := range matches {
+		match := Array{
+			Array{Integer(m.aStart), Integer(m.aEnd)},
+			Array{Integer(m.bStart), Integer(m.bEnd)},
+		}
+		if withMatchLen {
+			match = append(match, Integer(m.aEnd-m.aStart+1))
+		}
+		ranges = append(ranges, match)
+	}
+	return c.WriteReply(Map{BulkString("matches"), ranges, BulkString("len"), Integer(len(lcs))})
+}
+
+// lcsMatch is a run of the LCS that is contiguous in both strings, the ends
+// are inclusive
+type lcsMatch struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// longestCommonSubsequence fills the usual dynamic programming table and walks
+// it back from the end, so the matches come out last one first like in Redis.
+// Matches shorter than minMatchLen are left out of the list but not the LCS.
+func longestCommonSubsequence(a, b string, minMatchLen int64) (string, []lcsMatch) {
+	width := len(b) + 1
+	dp := make([]uint32, (len(a)+1)*width)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				dp[i*width+j] = dp[(i-1)*width+j-1] + 1
+			} else {
+				dp[i*width+j] = max(dp[(i-1)*width+j], dp[i*width+j-1])
+			}
+		}
+	}
+
+	idx := dp[len(a)*width+len(b)]
+	lcs := make([]byte, idx)
+	var matches []lcsMatch
+
+	// cur.aStart == len(a) means no match is being collected
+	cur := lcsMatch{aStart: len(a)}
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			lcs[idx-1] = a[i-1]
+			if cur.aStart == len(a) {
+				cur = lcsMatch{aStart: i - 1, aEnd: i - 1, bStart: j - 1, bEnd: j - 1}
+			} else {
+				cur.aStart--
+				cur.bStart--
+			}
+			emit = cur.aStart == 0 || cur.bStart == 0
+			idx--
+			i--
+			j--
+		} else {
+			if dp[(i-1)*width+j] > dp[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+			emit = cur.aStart != len(a)
+		}
+
+		if emit {
+			if int64(cur.aEnd-cur.aStart+1) >= minMatchLen {
+				matches = append(matches, cur)
+			}
+			cur.aStart = len(a)
+		}
+	}
+	return string(lcs), matches
+}
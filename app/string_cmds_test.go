@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestINCRBYFLOAT(t *testing.T) {
+	tests := []struct {
+		value string // empty for a missing key
+		incr  string
+		want  string
+	}{
+		{value: "", incr: "10.5", want: "$4\r\n10.5\r\n"},
+		{value: "10.50", incr: "0.1", want: "$4\r\n10.6\r\n"},
+		{value: "10.6", incr: "-5", want: "$3\r\n5.6\r\n"},
+		{value: "5.0e3", incr: "2.0e2", want: "$4\r\n5200\r\n"},
+		{value: "3", incr: "1.5", want: "$3\r\n4.5\r\n"},
+		{value: "1.5", incr: "1.5", want: "$1\r\n3\r\n"},
+		{value: "1", incr: "-1", want: "$1\r\n0\r\n"},
+		{value: "0.1", incr: "0.2", want: "$19\r\n0.30000000000000004\r\n"},
+		{value: "1e20", incr: "1", want: "$21\r\n100000000000000000000\r\n"},
+		{value: "", incr: "1e-7", want: "$9\r\n0.0000001\r\n"},
+		{value: " 1", incr: "1", want: "-ERR value is not a valid float\r\n"},
+		{value: "abc", incr: "1", want: "-ERR value is not a valid float\r\n"},
+		{value: "1", incr: "abc", want: "-ERR value is not a valid float\r\n"},
+		{value: "1", incr: "nan", want: "-ERR value is not a valid float\r\n"},
+		{value: "1", incr: "inf", want: "-ERR increment would produce NaN or Infinity\r\n"},
+		{value: "1.7e308", incr: "1.7e308", want: "-ERR increment would produce NaN or Infinity\r\n"},
+	}
+
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	for i, tt := range tests {
+		key := "k" + strconv.Itoa(i)
+		if tt.value != "" {
+			run(s, c, "SET", key, tt.value)
+		}
+		if got := run(s, c, "INCRBYFLOAT", key, tt.incr); got != tt.want {
+			t.Errorf("INCRBYFLOAT %q by %q = %q, want %q", tt.value, tt.incr, got, tt.want)
+		}
+	}
+}
+
+func TestLongestCommonSubsequence(t *testing.T) {
+	tests := []struct {
+		a, b        string
+		minMatchLen int64
+		want        string
+		matches     []lcsMatch
+	}{
+		{a: "", b: "", want: ""},
+		{a: "", b: "abc", want: ""},
+		{a: "abc", b: "xyz", want: ""},
+		{a: "abc", b: "abc", want: "abc", matches: []lcsMatch{{0, 2, 0, 2}}},
+		// the example from the Redis docs, last match first
+		{a: "ohmytext", b: "mynewtext", want: "mytext", matches: []lcsMatch{{4, 7, 5, 8}, {2, 3, 0, 1}}},
+		{a: "ohmytext", b: "mynewtext", minMatchLen: 2, want: "mytext", matches: []lcsMatch{{4, 7, 5, 8}, {2, 3, 0, 1}}},
+		{a: "ohmytext", b: "mynewtext", minMatchLen: 3, want: "mytext", matches: []lcsMatch{{4, 7, 5, 8}}},
+		{a: "ohmytext", b: "mynewtext", minMatchLen: 4, want: "mytext", matches: []lcsMatch{{4, 7, 5, 8}}},
+		{a: "ohmytext", b: "mynewtext", minMatchLen: 5, want: "mytext"},
+		{a: "axbxc", b: "abc", want: "abc", matches: []lcsMatch{{4, 4, 2, 2}, {2, 2, 1, 1}, {0, 0, 0, 0}}},
+		{a: "xxabc", b: "abcyy", want: "abc", matches: []lcsMatch{{2, 4, 0, 2}}},
+	}
+
+	for _, tt := range tests {
+		got, matches := longestCommonSubsequence(tt.a, tt.b, tt.minMatchLen)
+		if got != tt.want || !reflect.DeepEqual(matches, tt.matches) {
+			t.Errorf("longestCommonSubsequence(%q, %q, %d) = %q, %v, want %q, %v",
+				tt.a, tt.b, tt.minMatchLen, got, matches, tt.want, tt.matches)
+		}
+	}
+}
+
+func TestLCS(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{}, want: "$6\r\nmytext\r\n"},
+		{args: []string{"LEN"}, want: ":6\r\n"},
+		{
+			args: []string{"IDX"},
+			want: "*4\r\n$7\r\nmatches\r\n*2\r\n" +
+				"*2\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n" +
+				"*2\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n" +
+				"$3\r\nlen\r\n:6\r\n",
+		},
+		{
+			args: []string{"IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"},
+			want: "*4\r\n$7\r\nmatches\r\n*1\r\n" +
+				"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+				"$3\r\nlen\r\n:6\r\n",
+		},
+		{
+			args: []string{"IDX", "MINMATCHLEN", "-3", "WITHMATCHLEN"},
+			want: "*4\r\n$7\r\nmatches\r\n*2\r\n" +
+				"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+				"*3\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n:2\r\n" +
+				"$3\r\nlen\r\n:6\r\n",
+		},
+		{args: []string{"LEN", "IDX"}, want: "-ERR If you want both the length and indexes, please just use IDX.\r\n"},
+		{args: []string{"IDX", "MINMATCHLEN"}, want: "-ERR syntax error\r\n"},
+		{args: []string{"IDX", "MINMATCHLEN", "x"}, want: "-ERR value is not an integer or out of range\r\n"},
+	}
+
+	s := newTestServer(t)
+	c := newTestClient(t, s)
+	run(s, c, "MSET", "key1", "ohmytext", "key2", "mynewtext")
+
+	for _, tt := range tests {
+		args := append([]string{"LCS", "key1", "key2"}, tt.args...)
+		if got := run(s, c, args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", args, got, tt.want)
+		}
+	}
+}
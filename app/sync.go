@@ -2,32 +2,74 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Entry struct {
-	value string
-	time  int64
+	value    string
+	time     int64
+	accessed atomic.Int64 // unix millis of the last read, what OBJECT IDLETIME reports
 }
 
 type SafeMap struct {
 	mu sync.RWMutex
-	m  map[string]Entry
+	m  map[string]*Entry
+	// while it returns true expired keys are hidden but not deleted, set by
+	// the server so CLIENT PAUSE keeps the dataset still
+	expiryPaused func() bool
+	// called after a key was deleted for having expired
+	onExpire func(key string)
 }
 
 func NewSafeMap() *SafeMap {
 	return &SafeMap{
-		m: make(map[string]Entry),
+		m: make(map[string]*Entry),
 	}
 }
 
 func (s *SafeMap) Set(key string, value string, expiry int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.m[key] = Entry{value: value, time: expiry}
+	entry := &Entry{value: value, time: expiry}
+	entry.accessed.Store(time.Now().UnixMilli())
+	s.m[key] = entry
 }
 
+// Get returns the value of key and counts as an access to it
 func (s *SafeMap) Get(key string) (string, bool) {
+	return s.get(key, true)
+}
+
+// Peek is Get without updating the access time, for CLIENT NO-TOUCH
+func (s *SafeMap) Peek(key string) (string, bool) {
+	return s.get(key, false)
+}
+
+// IdleTime is how long ago key was last read or written
+func (s *SafeMap) IdleTime(key string) (time.Duration, bool) {
+	s.mu.RLock()
+	entry, ok := s.m[key]
+	s.mu.RUnlock()
+	if !ok || (entry.time != 0 && entry.time < time.Now().UnixMilli()) {
+		return 0, false
+	}
+	return time.Since(time.UnixMilli(entry.accessed.Load())), true
+}
+
+// Expiry returns the unix millis key expires at, 0 when it doesn't, without
+// counting as an access
+func (s *SafeMap) Expiry(key string) (int64, bool) {
+	s.mu.RLock()
+	entry, ok := s.m[key]
+	s.mu.RUnlock()
+	if !ok || (entry.time != 0 && entry.time < time.Now().UnixMilli()) {
+		return 0, false
+	}
+	return entry.time, true
+}
+
+func (s *SafeMap) get(key string, touch bool) (string, bool) {
 	s.mu.RLock()
 	entry, ok := s.m[key]
 	s.mu.RUnlock()
@@ -36,17 +78,208 @@ func (s *SafeMap) Get(key string) (string, bool) {
 	}
 
 	if entry.time != 0 && entry.time < time.Now().UnixMilli() {
+		if s.expiryPaused != nil && s.expiryPaused() {
+			return "", false
+		}
 		s.mu.Lock()
-		delete(s.m, key)
+		// the key may have been set again since we looked
+		deleted := s.m[key] == entry
+		if deleted {
+			delete(s.m, key)
+		}
 		s.mu.Unlock()
+		if !deleted {
+			return s.get(key, touch)
+		}
+		if s.onExpire != nil {
+			s.onExpire(key)
+		}
 		return "", false
 	}
+	if touch {
+		entry.accessed.Store(time.Now().UnixMilli())
+	}
 	return entry.value, true
 
 }
 
-func (s *SafeMap) Delete(key string) {
+// Delete removes key and reports whether it existed, an expired key is
+// removed too but doesn't count
+func (s *SafeMap) Delete(key string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	entry, ok := s.m[key]
+	if !ok {
+		return false
+	}
 	delete(s.m, key)
+	return entry.time == 0 || entry.time >= time.Now().UnixMilli()
+}
+
+// Rename moves src and its expiry to dst in one step, replacing dst unless nx
+// is set and it exists. found is false when there is no src.
+func (s *SafeMap) Rename(src, dst string, nx bool) (found bool, renamed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	entry, ok := s.m[src]
+	if !ok || (entry.time != 0 && entry.time < now) {
+		return false, false
+	}
+	if src == dst {
+		return true, false
+	}
+	if old, ok := s.m[dst]; nx && ok && (old.time == 0 || old.time >= now) {
+		return true, false
+	}
+	s.m[dst] = entry
+	delete(s.m, src)
+	return true, true
+}
+
+// Copy sets dst to the value and expiry of src, an existing dst is only
+// replaced when replace is set. The result says whether dst was written.
+func (s *SafeMap) Copy(src, dst string, replace bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	entry, ok := s.m[src]
+	if !ok || (entry.time != 0 && entry.time < now) {
+		return false
+	}
+	if old, ok := s.m[dst]; !replace && ok && (old.time == 0 || old.time >= now) {
+		return false
+	}
+	next := &Entry{value: entry.value, time: entry.time}
+	next.accessed.Store(now)
+	s.m[dst] = next
+	return true
+}
+
+// SetMany sets the key value pairs in pairs without an expiry, all under one
+// lock so no reader sees only part of them. With nx nothing is set when any
+// of the keys exists, the result says whether they were set.
+func (s *SafeMap) SetMany(pairs []string, nx bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	if nx {
+		for i := 0; i < len(pairs); i += 2 {
+			if entry, ok := s.m[pairs[i]]; ok && (entry.time == 0 || entry.time >= now) {
+				return false
+			}
+		}
+	}
+	for i := 0; i < len(pairs); i += 2 {
+		entry := &Entry{value: pairs[i+1]}
+		entry.accessed.Store(now)
+		s.m[pairs[i]] = entry
+	}
+	return true
+}
+
+// mutation is what a Mutate callback decided to do with the key
+type mutation int
+
+const (
+	mutateNone mutation = iota
+	mutateSet
+	mutateDelete
+)
+
+// Mutate runs fn on the current value of key with the write lock held, so
+// read-modify-write commands can't interleave with other writers. An expired
+// key is passed as missing. The new value and expiry are only used with
+// mutateSet, and the decision is returned to the caller.
+func (s *SafeMap) Mutate(key string, fn func(value string, expiry int64, exists bool) (string, int64, mutation)) mutation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, exists := s.m[key]
+	var value string
+	var expiry int64
+	if exists && entry.time != 0 && entry.time < time.Now().UnixMilli() {
+		exists = false
+	}
+	if exists {
+		value, expiry = entry.value, entry.time
+	}
+
+	newValue, newExpiry, op := fn(value, expiry, exists)
+	switch op {
+	case mutateSet:
+		next := &Entry{value: newValue, time: newExpiry}
+		next.accessed.Store(time.Now().UnixMilli())
+		s.m[key] = next
+	case mutateDelete:
+		delete(s.m, key)
+	}
+	return op
+}
+
+// snapshotEntry is a key as it is written to an RDB file
+type snapshotEntry struct {
+	key    string
+	value  string
+	expiry int64
+}
+
+// Snapshot copies every key that hasn't expired yet
+func (s *SafeMap) Snapshot() []snapshotEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	entries := make([]snapshotEntry, 0, len(s.m))
+	for key, entry := range s.m {
+		if entry.time != 0 && entry.time < now {
+			continue
+		}
+		entries = append(entries, snapshotEntry{key: key, value: entry.value, expiry: entry.time})
+	}
+	return entries
+}
+
+// Len counts the keys including expired ones not deleted yet, like DBSIZE
+// does in Redis
+func (s *SafeMap) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.m)
+}
+
+// RandomKey returns any key that hasn't expired, false when there is none
+func (s *SafeMap) RandomKey() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	// map iteration starts at a random position
+	for key, entry := range s.m {
+		if entry.time == 0 || entry.time >= now {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Keys returns every key that hasn't expired and matches the glob pattern
+func (s *SafeMap) Keys(pattern string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+	keys := []string{}
+	for key, entry := range s.m {
+		if entry.time != 0 && entry.time < now {
+			continue
+		}
+		if stringMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+func (c *Config) loadCertificate() (tls.Certificate, error) {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return tls.Certificate{}, errors.New("tls-cert-file and tls-key-file are required for TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func (c *Config) loadCAPool() (*x509.CertPool, error) {
+	if c.TLSCACertFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(c.TLSCACertFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.TLSCACertFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig is used by the TLS listener. tls-auth-clients decides
+// whether clients have to present a certificate signed by the CA.
+func (c *Config) serverTLSConfig() (*tls.Config, error) {
+	cert, err := c.loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := c.loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch c.TLSAuthClients {
+	case "yes":
+		if pool == nil {
+			return nil, errors.New("tls-auth-clients needs tls-ca-cert-file")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		if pool == nil {
+			return nil, errors.New("tls-auth-clients needs tls-ca-cert-file")
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		cfg.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients value: %s", c.TLSAuthClients)
+	}
+	return cfg, nil
+}
+
+// replicationTLSConfig is used by a replica dialing its master. The master's
+// certificate is checked against the CA but not against a hostname, Redis
+// doesn't do that either since masters are usually configured by IP.
+func (c *Config) replicationTLSConfig() (*tls.Config, error) {
+	pool, err := c.loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// verification is done below without the hostname check
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("master did not present a certificate")
+			}
+			opts := x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range state.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+
+	// present our own certificate, masters usually require one
+	if c.TLSCertFile != "" && c.TLSKeyFile != "" {
+		cert, err := c.loadCertificate()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// trackingTable remembers who has to hear about a key changing. In the
+// default mode that is every client that read the key since it last changed,
+// in BCAST mode every client with a matching prefix. Entries point at client
+// IDs, clientKeys is the same key entries by client so they can be dropped
+// when tracking is turned off or the client goes away.
+type trackingTable struct {
+	mu         sync.Mutex
+	keys       map[string]map[int64]struct{}
+	clientKeys map[int64]map[string]struct{}
+	prefixes   map[string]map[int64]struct{}
+}
+
+func newTrackingTable() *trackingTable {
+	return &trackingTable{
+		keys:       make(map[string]map[int64]struct{}),
+		clientKeys: make(map[int64]map[string]struct{}),
+		prefixes:   make(map[string]map[int64]struct{}),
+	}
+}
+
+// trackingModes are the flags CLIENT TRACKING ON replaces every time
+const trackingModes = ClientTrackingBcast | ClientTrackingOptIn | ClientTrackingOptOut | ClientTrackingNoLoop | ClientTrackingBrokenRedir
+
+func (s *RedisServer) enableTracking(c *Client, redirect int64, options ClientFlag, prefixes []string) {
+	c.mu.Lock()
+	c.flags &^= trackingModes
+	c.flags |= ClientTracking | options
+	c.trackingRedirect = redirect
+	if options&ClientTrackingBcast != 0 {
+		if len(prefixes) == 0 {
+			prefixes = []string{""}
+		}
+		c.trackingPrefixes = append(c.trackingPrefixes, prefixes...)
+	}
+	c.mu.Unlock()
+
+	if options&ClientTrackingBcast == 0 {
+		return
+	}
+
+	s.tracking.mu.Lock()
+	defer s.tracking.mu.Unlock()
+	for _, prefix := range prefixes {
+		ids, ok := s.tracking.prefixes[prefix]
+		if !ok {
+			ids = make(map[int64]struct{})
+			s.tracking.prefixes[prefix] = ids
+		}
+		ids[c.ID] = struct{}{}
+	}
+}
+
+// disableTracking turns tracking off and forgets the keys and prefixes the
+// client was tracking, it is also how a client that goes away is cleaned up
+func (s *RedisServer) disableTracking(c *Client) {
+	c.mu.Lock()
+	prefixes := c.trackingPrefixes
+	c.flags &^= ClientTracking | ClientTrackingCaching | trackingModes
+	c.trackingRedirect = 0
+	c.trackingPrefixes = nil
+	c.mu.Unlock()
+
+	s.tracking.mu.Lock()
+	defer s.tracking.mu.Unlock()
+	for _, prefix := range prefixes {
+		if ids, ok := s.tracking.prefixes[prefix]; ok {
+			delete(ids, c.ID)
+			if len(ids) == 0 {
+				delete(s.tracking.prefixes, prefix)
+			}
+		}
+	}
+	for key := range s.tracking.clientKeys[c.ID] {
+		if ids, ok := s.tracking.keys[key]; ok {
+			delete(ids, c.ID)
+			if len(ids) == 0 {
+				delete(s.tracking.keys, key)
+			}
+		}
+	}
+	delete(s.tracking.clientKeys, c.ID)
+}
+
+// prefixCollision returns a pair of prefixes where one starts with the other,
+// checking the new ones against each other and against those already in use
+func (c *Client) prefixCollision(prefixes []string) (string, string, bool) {
+	c.mu.Lock()
+	existing := c.trackingPrefixes
+	c.mu.Unlock()
+
+	for i, prefix := range prefixes {
+		for _, other := range existing {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return prefix, other, true
+			}
+		}
+		for _, other := range prefixes[i+1:] {
+			if strings.HasPrefix(prefix, other) || strings.HasPrefix(other, prefix) {
+				return prefix, other, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// trackingRememberKeys records the keys a read only command touched, unless
+// OPTIN or OPTOUT together with CLIENT CACHING say otherwise
+func (s *RedisServer) trackingRememberKeys(c *Client, command *Command, args []string) {
+	c.mu.Lock()
+	flags := c.flags
+	c.mu.Unlock()
+
+	if flags&ClientTracking == 0 || flags&ClientTrackingBcast != 0 {
+		return
+	}
+	caching := flags&ClientTrackingCaching != 0
+	if flags&ClientTrackingOptIn != 0 && !caching {
+		return
+	}
+	if flags&ClientTrackingOptOut != 0 && caching {
+		return
+	}
+
+	argv := append([]string{command.Name}, args...)
+	indexes := command.getKeys(argv)
+	if len(indexes) == 0 {
+		return
+	}
+
+	s.tracking.mu.Lock()
+	defer s.tracking.mu.Unlock()
+	keys, ok := s.tracking.clientKeys[c.ID]
+	if !ok {
+		keys = make(map[string]struct{})
+		s.tracking.clientKeys[c.ID] = keys
+	}
+	for _, i := range indexes {
+		ids, ok := s.tracking.keys[argv[i]]
+		if !ok {
+			ids = make(map[int64]struct{})
+			s.tracking.keys[argv[i]] = ids
+		}
+		ids[c.ID] = struct{}{}
+		keys[argv[i]] = struct{}{}
+	}
+}
+
+// trackingInvalidateKey tells everyone tracking key that it changed. c is the
+// client that changed it, nil when the key expired.
+func (s *RedisServer) trackingInvalidateKey(c *Client, key string) {
+	s.tracking.mu.Lock()
+	var ids []int64
+	for id := range s.tracking.keys[key] {
+		ids = append(ids, id)
+		if keys, ok := s.tracking.clientKeys[id]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(s.tracking.clientKeys, id)
+			}
+		}
+	}
+	delete(s.tracking.keys, key)
+
+	var bcastIDs []int64
+	for prefix, clients := range s.tracking.prefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for id := range clients {
+			bcastIDs = append(bcastIDs, id)
+		}
+	}
+	s.tracking.mu.Unlock()
+
+	for _, id := range ids {
+		target := s.lookupClient(id)
+		// tracking may have been turned off or switched to BCAST since the read
+		if target == nil || !target.hasFlag(ClientTracking) || target.hasFlag(ClientTrackingBcast) {
+			continue
+		}
+		if target == c && target.hasFlag(ClientTrackingNoLoop) {
+			continue
+		}
+		s.sendTrackingMessage(target, key)
+	}
+
+	for _, id := range bcastIDs {
+		target := s.lookupClient(id)
+		if target == nil || (target == c && target.hasFlag(ClientTrackingNoLoop)) {
+			continue
+		}
+		s.sendTrackingMessage(target, key)
+	}
+}
+
+// sendTrackingMessage delivers an invalidation either to the tracking client
+// itself or to its redirect target. RESP3 connections get a push frame, a
+// RESP2 redirect target has to be subscribed to __redis__:invalidate, and a
+// RESP2 client without a redirect has no way to receive anything.
+func (s *RedisServer) sendTrackingMessage(c *Client, key string) {
+	c.mu.Lock()
+	redirect := c.trackingRedirect
+	c.mu.Unlock()
+
+	target := c
+	if redirect != 0 {
+		target = s.lookupClient(redirect)
+		if target == nil {
+			c.mu.Lock()
+			alreadyBroken := c.flags&ClientTrackingBrokenRedir != 0
+			c.flags |= ClientTrackingBrokenRedir
+			proto := c.Proto
+			c.mu.Unlock()
+
+			if !alreadyBroken && proto == 3 {
+				c.WritePush(Push{BulkString("tracking-redir-broken"), Integer(redirect)})
+				c.Flush()
+			}
+			return
+		}
+	}
+
+	target.mu.Lock()
+	proto := target.Proto
+	target.mu.Unlock()
+
+	keys := Array{BulkString(key)}
+	switch {
+	case proto == 3:
+		target.WritePush(Push{BulkString("invalidate"), keys})
+	case redirect != 0 && target.hasFlag(ClientPubSub):
+		target.WritePush(Push{BulkString("message"), BulkString(invalidateChannel), keys})
+	default:
+		return
+	}
+	target.Flush()
+}
@@ -3,12 +3,11 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 )
 
-func isWrite(cmd string) bool {
-	return cmd == "SET" || cmd == "DEL"
-}
-
 func bytesToInt64LE(b []byte) int64 {
 	if len(b) == 8 {
 		return int64(binary.LittleEndian.Uint64(b))
@@ -28,7 +27,175 @@ func bytesToInt64LE(b []byte) int64 {
 	return int64(value)
 }
 
-// For big-endian
+// For big-endian, any length up to 8 bytes
 func bytesToInt64BE(b []byte) int64 {
-	return int64(binary.BigEndian.Uint64(b))
+	var value uint64
+	for _, c := range b {
+		value = value<<8 | uint64(c)
+	}
+	return int64(value)
+}
+
+// validClientName rejects names that would break the space separated
+// CLIENT LIST output
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMemory reads sizes the way redis.conf writes them, 1k is 1000 bytes and
+// 1kb is 1024
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory value: %s", value)
+	}
+	return n * mul, nil
+}
+
+func wrongArgsError(name string) ErrorReply {
+	return ErrorReply(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+// unknownCommandError echoes back the start of the arguments like Redis does,
+// long arguments are cut so a bogus request can't make the error huge
+func unknownCommandError(cmd string, args []string) ErrorReply {
+	var b strings.Builder
+	for _, arg := range args {
+		if b.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&b, "'%.*s' ", 128-b.Len(), arg)
+	}
+	return ErrorReply(fmt.Sprintf("ERR unknown command '%.128s', with args beginning with: %s", cmd, b.String()))
+}
+
+// stringMatch is the glob matching Redis uses for KEYS and friends: * and ?
+// wildcards, [abc], [^abc] and [a-z] classes, and backslash escapes
+func stringMatch(pattern string, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if stringMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// unterminated class, treat the end of the pattern as the bracket
+				pattern = "]"
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// parseInt64 only accepts the canonical form of an integer, like string2ll in
+// Redis: no sign but '-', no leading zeros and no spaces
+func parseInt64(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseFloat rejects NaN and surrounding spaces, infinity parses but no
+// command can store it
+func parseFloat(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
 }